@@ -0,0 +1,18 @@
+##@ Testing
+
+ENVTEST_K8S_VERSION ?= 1.19.2
+ENVTEST_DIR         ?= $(shell pwd)/testbin
+
+# envtest tests of the controllers are skipped without the etcd and kube-apiserver binaries
+export KUBEBUILDER_ASSETS ?= $(ENVTEST_DIR)/bin
+
+.PHONY: envtest-assets
+envtest-assets: ## Downloads etcd, kube-apiserver and kubectl binaries used by the envtest tests.
+	@echo "====> $@"
+	@if [ ! -x "$(KUBEBUILDER_ASSETS)/kube-apiserver" ]; then \
+		mkdir -p $(ENVTEST_DIR); \
+		curl -sSLf https://storage.googleapis.com/kubebuilder-tools/kubebuilder-tools-$(ENVTEST_K8S_VERSION)-$(OS)-$(shell go env GOARCH).tar.gz \
+			| tar -xz --strip-components=1 -C $(ENVTEST_DIR); \
+	fi
+
+test: envtest-assets
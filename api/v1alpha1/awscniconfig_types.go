@@ -0,0 +1,159 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AWSCNIConfigSpec defines the desired CNI networking of a cluster
+type AWSCNIConfigSpec struct {
+	// CIDR is the secondary VPC CIDR block used for the CNI subnets.
+	// If empty, the CIDR is taken from the AWSCluster annotation, the CIDR pool or the operator default.
+	// +optional
+	CIDR string `json:"cidr,omitempty"`
+
+	// SubnetMaskSize is the mask size of each per AZ CNI subnet.
+	// If not set, the CIDR is split evenly between all availability zones.
+	// +optional
+	// +kubebuilder:validation:Minimum=16
+	// +kubebuilder:validation:Maximum=28
+	SubnetMaskSize *int `json:"subnetMaskSize,omitempty"`
+
+	// SecurityGroupIDs are additional security groups attached to pod ENIs next to the cluster node security group.
+	// +optional
+	SecurityGroupIDs []string `json:"securityGroupIDs,omitempty"`
+
+	// Tags are additional AWS tags added to the CNI subnets.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// ENIConfig holds options for the ENIConfigs created in the workload cluster.
+	// +optional
+	ENIConfig ENIConfigOptions `json:"eniConfig,omitempty"`
+
+	// Expansion enables automatic association of additional CIDRs when the CNI subnets run out of IP addresses.
+	// +optional
+	Expansion *ExpansionPolicy `json:"expansion,omitempty"`
+
+	// ExistingSubnets switches the cluster to bring-your-own VPC mode. The listed subnets are used for the ENIConfigs
+	// as they are, no CIDR is associated with the VPC and no subnet is created, modified or deleted.
+	// +optional
+	ExistingSubnets []ExistingSubnet `json:"existingSubnets,omitempty"`
+}
+
+// ExistingSubnet selects a pre-existing CNI subnet of a single availability zone by ID or by tags
+type ExistingSubnet struct {
+	// AvailabilityZone is the availability zone the subnet is used for.
+	AvailabilityZone string `json:"availabilityZone"`
+
+	// ID is the ID of the subnet.
+	// +optional
+	ID string `json:"id,omitempty"`
+
+	// Tags select the subnet when ID is not set, exactly one subnet in the cluster VPC and availability zone must match.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// ExpansionPolicy defines when and how CNI capacity is expanded
+type ExpansionPolicy struct {
+	// UtilizationThreshold is the percentage of used IP addresses in any active CNI subnet above which an additional CIDR is added.
+	// Defaults to 80.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	UtilizationThreshold int `json:"utilizationThreshold,omitempty"`
+
+	// CIDRs are used in order as additional CIDRs. If empty, additional CIDRs are allocated from the operator CIDR pool.
+	// +optional
+	CIDRs []string `json:"cidrs,omitempty"`
+
+	// MaxAdditionalCIDRs limits the number of additional CIDRs, AWS allows 5 CIDRs per VPC by default.
+	// Defaults to 3.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MaxAdditionalCIDRs int `json:"maxAdditionalCIDRs,omitempty"`
+}
+
+// ENIConfigOptions defines additional metadata for ENIConfigs
+type ENIConfigOptions struct {
+	// Labels are added to every ENIConfig.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations are added to every ENIConfig.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// AWSCNIConfigStatus defines the observed CNI networking of a cluster
+type AWSCNIConfigStatus struct {
+	// CIDR is the secondary VPC CIDR block currently used for the CNI subnets.
+	// +optional
+	CIDR string `json:"cidr,omitempty"`
+
+	// AdditionalCIDRs are the secondary VPC CIDR blocks added by capacity expansion.
+	// +optional
+	AdditionalCIDRs []string `json:"additionalCIDRs,omitempty"`
+
+	// Subnets are the CNI subnets allocated for the cluster.
+	// +optional
+	Subnets []SubnetStatus `json:"subnets,omitempty"`
+
+	// Ready is true once the subnets are created and ENIConfigs are applied in the workload cluster.
+	// +optional
+	Ready bool `json:"ready"`
+}
+
+// SubnetStatus describes a CNI subnet in a single availability zone
+type SubnetStatus struct {
+	AvailabilityZone string `json:"availabilityZone"`
+	ID               string `json:"id"`
+	CIDRBlock        string `json:"cidrBlock,omitempty"`
+	// Active is true when the subnet is used by ENIConfigs for new ENIs.
+	Active bool `json:"active"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".metadata.labels.cluster\\.x-k8s\\.io/cluster-name"
+//+kubebuilder:printcolumn:name="CIDR",type="string",JSONPath=".status.cidr"
+//+kubebuilder:printcolumn:name="Ready",type="boolean",JSONPath=".status.ready"
+
+// AWSCNIConfig is the Schema for the awscniconfigs API.
+// It is matched to a cluster by the cluster.x-k8s.io/cluster-name label in the AWSCluster namespace.
+type AWSCNIConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSCNIConfigSpec   `json:"spec,omitempty"`
+	Status AWSCNIConfigStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AWSCNIConfigList contains a list of AWSCNIConfig
+type AWSCNIConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSCNIConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AWSCNIConfig{}, &AWSCNIConfigList{})
+}
@@ -18,20 +18,36 @@ package controllers
 
 import (
 	"context"
-	"fmt"
-	"time"
+	"reflect"
+	"strings"
 
+	awsclientaws "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
 	"github.com/giantswarm/capa-aws-cni-operator/pkg/awsclient"
-	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
 	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/wcclient"
 )
 
 // AWSClusterReconciler reconciles a AWSMachinePool object
@@ -40,20 +56,47 @@ type AWSClusterReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
-	DefaultCNICIDR string
+	// APIVersion is the served version of the Cluster API and CAPA APIs, v1alpha3 is used when empty
+	APIVersion string
+	// APIReader reads CNI CIDRs of other clusters from the API server when allocating from the pool
+	APIReader client.Reader
+	// CAPANamespace is the namespace of the CAPA controller with secrets of v1beta1 static identities
+	CAPANamespace   string
+	CNICIDRPool     string
+	CNICIDRMaskSize int
+	DefaultCNICIDR  string
+	// SubnetFreeIPsThreshold is the number of free IPs in a CNI subnet below which a warning is reported
+	SubnetFreeIPsThreshold int64
+	// ServiceEndpoints replace the default AWS service endpoints, e.g. to run the reconciler against a stand-in EC2 backend
+	ServiceEndpoints []scope.ServiceEndpoint
+	// EnableEKS makes the CIDR allocator reserve CNI CIDRs of EKS clusters as well
+	EnableEKS bool
+	// WatchFilterValue is the value of the watch-filter label AWSClusters must have to be reconciled
+	WatchFilterValue string
+	// WCClients caches workload cluster k8s clients
+	WCClients *wcclient.Cache
 }
 
 //+kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=awsmachinepools,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=awsmachinepools/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=awsmachinepools/finalizers,verbs=update
+//+kubebuilder:rbac:groups=aws-cni.giantswarm.io,resources=awscniconfigs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=aws-cni.giantswarm.io,resources=awscniconfigs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *AWSClusterReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	var err error
 	ctx := context.TODO()
 	logger := r.Log.WithValues("namespace", req.Namespace, "awsCluster", req.Name)
 
-	awsCluster := &capa.AWSCluster{}
-	err = r.Get(ctx, req.NamespacedName, awsCluster)
+	var cluster cniCluster = &awsClusterAdapter{awsCluster: &capa.AWSCluster{}}
+	if r.APIVersion == key.V1beta1APIVersion {
+		cluster = &awsClusterV1beta1Adapter{awsCluster: &v1beta1.AWSCluster{}}
+	}
+	err := r.Get(ctx, req.NamespacedName, cluster.object())
 	if k8serrors.IsNotFound(err) {
 		// CR is gone, stop reconciling
 		return ctrl.Result{
@@ -64,151 +107,333 @@ func (r *AWSClusterReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, err
 	}
 
-	// check if CR got CAPI watch-filter label
-	if !key.HasCapiWatchLabel(awsCluster.Labels) {
-		logger.Info(fmt.Sprintf("AWSCluster do not have %s=%s label, ignoring CR", key.ClusterWatchFilterLabel, "capi"))
-		// ignoring this CR
-		return ctrl.Result{}, nil
+	cniReconciler := &cniReconciler{
+		Client:                 r.Client,
+		apiVersion:             r.APIVersion,
+		apiReader:              r.APIReader,
+		capaNamespace:          r.CAPANamespace,
+		cniCIDRPool:            r.CNICIDRPool,
+		cniCIDRMaskSize:        r.CNICIDRMaskSize,
+		defaultCNICIDR:         r.DefaultCNICIDR,
+		eksEnabled:             r.EnableEKS,
+		subnetFreeIPsThreshold: r.SubnetFreeIPsThreshold,
+		serviceEndpoints:       r.ServiceEndpoints,
+		wcClients:              r.WCClients,
 	}
+	return cniReconciler.reconcile(ctx, cluster, logger)
+}
 
-	clusterName := key.GetClusterIDFromLabels(awsCluster.ObjectMeta)
+// awsClusterAdapter adapts AWSCluster to the shared CNI reconciliation
+type awsClusterAdapter struct {
+	awsCluster *capa.AWSCluster
+}
 
-	logger = logger.WithValues("cluster", clusterName)
+func (a *awsClusterAdapter) object() conditions.Setter {
+	return a.awsCluster
+}
 
-	if awsCluster.Spec.NetworkSpec.VPC.ID == "" {
-		logger.Info("AWSCluster does not have vpc id set yet")
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: time.Minute * 2,
-		}, nil
-	}
+func (a *awsClusterAdapter) kind() string {
+	return "AWSCluster"
+}
 
-	if len(awsCluster.Spec.NetworkSpec.Subnets.GetUniqueZones()) == 0 {
-		logger.Info("AWSCluster does not have subnets set yet")
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: time.Minute * 2,
-		}, nil
+func (a *awsClusterAdapter) networkSpec() capa.NetworkSpec {
+	return a.awsCluster.Spec.NetworkSpec
+}
+
+func (a *awsClusterAdapter) securityGroups() map[capa.SecurityGroupRole]capa.SecurityGroup {
+	return a.awsCluster.Status.Network.SecurityGroups
+}
+
+func (a *awsClusterAdapter) additionalTags() capa.Tags {
+	return a.awsCluster.Spec.AdditionalTags
+}
+
+func (a *awsClusterAdapter) kubeconfigSecretName(clusterName string) string {
+	return key.KubeconfigSecretName(clusterName)
+}
+
+func (a *awsClusterAdapter) paused(ctx context.Context, ctrlClient client.Client) (bool, error) {
+	return ownerClusterPaused(ctx, ctrlClient, a.awsCluster)
+}
+
+func (a *awsClusterAdapter) awsSession(ctx context.Context, awsClientGetter *awsclient.AwsClient) (awsclientaws.ConfigProvider, error) {
+	return awsClientGetter.GetAWSClientSession(ctx)
+}
+
+// awsClusterV1beta1Adapter adapts v1beta1 AWSCluster to the shared CNI reconciliation
+type awsClusterV1beta1Adapter struct {
+	awsCluster *v1beta1.AWSCluster
+}
+
+func (a *awsClusterV1beta1Adapter) object() conditions.Setter {
+	return a.awsCluster
+}
+
+func (a *awsClusterV1beta1Adapter) kind() string {
+	return "AWSCluster"
+}
+
+func (a *awsClusterV1beta1Adapter) networkSpec() capa.NetworkSpec {
+	return a.awsCluster.Spec.NetworkSpec
+}
+
+func (a *awsClusterV1beta1Adapter) securityGroups() map[capa.SecurityGroupRole]capa.SecurityGroup {
+	return a.awsCluster.Status.Network.SecurityGroups
+}
+
+func (a *awsClusterV1beta1Adapter) additionalTags() capa.Tags {
+	return a.awsCluster.Spec.AdditionalTags
+}
+
+func (a *awsClusterV1beta1Adapter) kubeconfigSecretName(clusterName string) string {
+	return key.KubeconfigSecretName(clusterName)
+}
+
+func (a *awsClusterV1beta1Adapter) paused(ctx context.Context, ctrlClient client.Client) (bool, error) {
+	return v1beta1OwnerClusterPaused(ctx, ctrlClient, a.awsCluster)
+}
+
+func (a *awsClusterV1beta1Adapter) awsSession(ctx context.Context, awsClientGetter *awsclient.AwsClient) (awsclientaws.ConfigProvider, error) {
+	return awsClientGetter.GetV1beta1AWSClientSession(ctx)
+}
+
+// awsCNIConfigToAWSCluster maps AWSCNIConfig to the AWSCluster of the same cluster
+func (r *AWSClusterReconciler) awsCNIConfigToAWSCluster(o handler.MapObject) []reconcile.Request {
+	return r.awsClusterRequests(o.Meta.GetNamespace(), o.Meta.GetLabels()[key.ClusterNameLabel])
+}
+
+// clusterToAWSCluster maps CAPI Cluster to the AWSCluster of the cluster
+func (r *AWSClusterReconciler) clusterToAWSCluster(o handler.MapObject) []reconcile.Request {
+	return r.awsClusterRequests(o.Meta.GetNamespace(), o.Meta.GetName())
+}
+
+// kubeconfigSecretToAWSCluster maps the <cluster>-kubeconfig Secret to the AWSCluster of the cluster
+func (r *AWSClusterReconciler) kubeconfigSecretToAWSCluster(o handler.MapObject) []reconcile.Request {
+	clusterName := o.Meta.GetLabels()[key.ClusterNameLabel]
+	if clusterName == "" {
+		clusterName = strings.TrimSuffix(o.Meta.GetName(), key.KubeconfigSecretName(""))
+	}
+	if o.Meta.GetName() != key.KubeconfigSecretName(clusterName) {
+		return nil
 	}
 
-	if _, ok := awsCluster.Status.Network.SecurityGroups[key.CNINodeSecurityGroupName]; !ok {
-		logger.Info("AWSCluster does not have security group ready yet")
-		return ctrl.Result{
-			Requeue:      true,
-			RequeueAfter: time.Minute * 2,
-		}, nil
+	return r.awsClusterRequests(o.Meta.GetNamespace(), clusterName)
+}
+
+// awsClusterRequests returns reconcile requests for AWSClusters labeled with the cluster name in the namespace
+// which match the watch filter
+func (r *AWSClusterReconciler) awsClusterRequests(namespace string, clusterName string) []reconcile.Request {
+	if clusterName == "" {
+		return nil
 	}
 
-	var awsClientGetter *awsclient.AwsClient
-	{
-		c := awsclient.AWSClientConfig{
-			ClusterName: clusterName,
-			CtrlClient:  r.Client,
-			Log:         logger,
-		}
-		awsClientGetter, err = awsclient.New(c)
-		if err != nil {
-			logger.Error(err, "failed to generate awsClientGetter")
-			return ctrl.Result{}, err
-		}
+	labels := client.MatchingLabels{key.ClusterNameLabel: clusterName}
+	if r.WatchFilterValue != "" {
+		labels[key.ClusterWatchFilterLabel] = r.WatchFilterValue
 	}
 
-	awsClientSession, err := awsClientGetter.GetAWSClientSession(ctx)
+	var awsClusterList runtime.Object = &capa.AWSClusterList{}
+	if r.APIVersion == key.V1beta1APIVersion {
+		awsClusterList = &v1beta1.AWSClusterList{}
+	}
+	err := r.List(context.TODO(),
+		awsClusterList,
+		client.InNamespace(namespace),
+		labels,
+	)
 	if err != nil {
-		logger.Error(err, "Failed to get aws client session")
-		return ctrl.Result{}, err
+		r.Log.Error(err, "failed to list AWSClusters", "namespace", namespace, "cluster", clusterName)
+		return nil
 	}
 
-	cniSecurityGroupID := awsCluster.Status.Network.SecurityGroups[key.CNINodeSecurityGroupName].ID
+	requests, err := listRequests(awsClusterList)
+	if err != nil {
+		r.Log.Error(err, "failed to read AWSClusters", "namespace", namespace, "cluster", clusterName)
+		return nil
+	}
+	return requests
+}
 
-	var cniService *cni.CNIService
-	// config for the CNI service
-	config := cni.CNIConfig{
-		AWSSession:         awsClientSession,
-		ClusterName:        clusterName,
-		CNISecurityGroupID: cniSecurityGroupID,
-		CtrlClient:         nil,              // we only need wc k8s client for resource creation, we dont need it for deletion, when cluster is being deleted it might not be avaiable
-		CNICIDR:            r.DefaultCNICIDR, // we use default for now, but we might need a way how to get specify per cluster
-		Log:                logger,
-		VPCAzList:          awsCluster.Spec.NetworkSpec.Subnets.GetUniqueZones(),
-		VPCID:              awsCluster.Spec.NetworkSpec.VPC.ID,
+// listRequests returns reconcile requests for all items of the list
+func listRequests(list runtime.Object) ([]reconcile.Request, error) {
+	items, err := apimeta.ExtractList(list)
+	if err != nil {
+		return nil, err
 	}
 
-	logger.Info("reconciling CR")
-	// delete CNI resource
-	if awsCluster.DeletionTimestamp != nil {
-		cniService, err = cni.New(config)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
-		err = cniService.Delete()
+	var requests []reconcile.Request
+	for _, item := range items {
+		m, err := apimeta.Accessor(item)
 		if err != nil {
-			return ctrl.Result{}, err
+			return nil, err
 		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: m.GetNamespace(), Name: m.GetName()},
+		})
+	}
+	return requests, nil
+}
 
-		err = r.Get(ctx, req.NamespacedName, awsCluster)
-		if err != nil {
-			logger.Error(err, "failed to fetch latest AWSCluster")
-			return ctrl.Result{}, err
-		}
-		if key.HasFinalizer(awsCluster.Finalizers) {
-			controllerutil.RemoveFinalizer(awsCluster, key.FinalizerName)
-			err = r.Update(ctx, awsCluster)
-			if err != nil {
-				logger.Error(err, "failed to remove finalizer on AWSCluster")
-				return ctrl.Result{}, err
-			}
-		}
-		// all resources were deleted, we dont have to reconcile anymore
-		return ctrl.Result{
-			Requeue: false,
-		}, nil
-	} else { // create CNI resource
-		wcClient, err := key.GetWCK8sClient(ctx, r.Client, clusterName, awsCluster.Namespace)
-		if k8serrors.IsNotFound(err) {
-			logger.Info("WC k8s api secrets are not ready yet")
-			return ctrl.Result{
-				Requeue:      true,
-				RequeueAfter: time.Minute * 2,
-			}, nil
-		} else if err != nil {
-			return ctrl.Result{}, err
-		}
-		config.CtrlClient = wcClient
-		cniService, err = cni.New(config)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
+// hasWatchFilterLabel passes objects with the watch-filter label set to the value, empty value passes every object
+func hasWatchFilterLabel(watchFilterValue string) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return key.HasWatchFilterLabel(e.Meta.GetLabels(), watchFilterValue)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return key.HasWatchFilterLabel(e.MetaNew.GetLabels(), watchFilterValue)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return key.HasWatchFilterLabel(e.Meta.GetLabels(), watchFilterValue)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return key.HasWatchFilterLabel(e.Meta.GetLabels(), watchFilterValue)
+		},
+	}
+}
 
-		// add finalizer to AWSCluster
-		if !key.HasFinalizer(awsCluster.Finalizers) {
-			controllerutil.AddFinalizer(awsCluster, key.FinalizerName)
-			err = r.Update(ctx, awsCluster)
-			if err != nil {
-				logger.Error(err, "failed to add finalizer on AWSCluster")
-				return ctrl.Result{}, err
+// clusterReadinessChanged passes new Clusters, Clusters whose infrastructure or control plane became ready
+// and Clusters which were paused or unpaused
+func clusterReadinessChanged() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldState, ok := getClusterState(e.ObjectOld)
+			if !ok {
+				return false
 			}
-		}
-		err = cniService.Reconcile()
-		if IsAWSCNINotFoundError(err) {
-			return ctrl.Result{
-				Requeue:      true,
-				RequeueAfter: time.Minute * 2,
-			}, nil
-		} else if err != nil {
-			return ctrl.Result{}, err
-		}
+			newState, ok := getClusterState(e.ObjectNew)
+			if !ok {
+				return false
+			}
+			return oldState != newState
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
 	}
+}
 
-	return ctrl.Result{
-		Requeue:      true,
-		RequeueAfter: time.Minute * 5,
-	}, nil
+// clusterState is the readiness and pause state of the Cluster
+type clusterState struct {
+	infrastructureReady     bool
+	controlPlaneInitialized bool
+	controlPlaneReady       bool
+	paused                  bool
+	pausedAnnotation        bool
+}
+
+// getClusterState returns state of the v1alpha3 or v1beta1 Cluster, v1beta1 replaced the
+// controlPlaneInitialized field with a condition
+func getClusterState(o runtime.Object) (clusterState, bool) {
+	switch c := o.(type) {
+	case *capi.Cluster:
+		return clusterState{
+			infrastructureReady:     c.Status.InfrastructureReady,
+			controlPlaneInitialized: c.Status.ControlPlaneInitialized,
+			controlPlaneReady:       c.Status.ControlPlaneReady,
+			paused:                  c.Spec.Paused,
+			pausedAnnotation:        annotations.HasPausedAnnotation(c),
+		}, true
+	case *v1beta1.Cluster:
+		return clusterState{
+			infrastructureReady:     c.Status.InfrastructureReady,
+			controlPlaneInitialized: conditions.IsTrue(c, v1beta1.ControlPlaneInitializedCondition),
+			controlPlaneReady:       c.Status.ControlPlaneReady,
+			paused:                  c.Spec.Paused,
+			pausedAnnotation:        annotations.HasPausedAnnotation(c),
+		}, true
+	}
+	return clusterState{}, false
+}
+
+// kubeconfigSecretChanged passes WC kubeconfig Secrets when they are created or their content changes
+func kubeconfigSecretChanged() predicate.Predicate {
+	isKubeconfig := func(m metav1.Object) bool {
+		return strings.HasSuffix(m.GetName(), key.KubeconfigSecretName(""))
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isKubeconfig(e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !isKubeconfig(e.MetaNew) {
+				return false
+			}
+			oldSecret, ok := e.ObjectOld.(*corev1.Secret)
+			if !ok {
+				return false
+			}
+			newSecret, ok := e.ObjectNew.(*corev1.Secret)
+			if !ok {
+				return false
+			}
+			return !reflect.DeepEqual(oldSecret.Data, newSecret.Data)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *AWSClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&capa.AWSCluster{}).
-		Complete(r)
+	c, err := controller.New("awscluster", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	var awsCluster runtime.Object = &capa.AWSCluster{}
+	if r.APIVersion == key.V1beta1APIVersion {
+		awsCluster = &v1beta1.AWSCluster{}
+	}
+
+	// AWSClusters without the watch-filter label are never queued
+	err = c.Watch(
+		&source.Kind{Type: awsCluster},
+		&handler.EnqueueRequestForObject{},
+		hasWatchFilterLabel(r.WatchFilterValue),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(
+		&source.Kind{Type: &v1alpha1.AWSCNIConfig{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.awsCNIConfigToAWSCluster)},
+	)
+	if err != nil {
+		return err
+	}
+
+	// reconcile as soon as the cluster infrastructure or control plane becomes ready
+	err = c.Watch(
+		&source.Kind{Type: clusterType(r.APIVersion)},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.clusterToAWSCluster)},
+		clusterReadinessChanged(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// reconcile as soon as the WC kubeconfig is created or rotated
+	err = c.Watch(
+		&source.Kind{Type: &corev1.Secret{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.kubeconfigSecretToAWSCluster)},
+		kubeconfigSecretChanged(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
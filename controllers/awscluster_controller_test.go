@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	eniv1alpha1 "github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	"github.com/aws/aws-sdk-go/aws"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni/fake"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/wcclient"
+)
+
+const (
+	testClusterName = "test"
+	testNamespace   = "default"
+	testTimeout     = time.Minute
+
+	testIdentityName = "test-identity"
+	testAccessKeyID  = "AKIATEST"
+)
+
+func Test_AWSClusterReconciler(t *testing.T) {
+	requireEnvtest(t)
+	ctx := context.Background()
+
+	ec2Client := fake.NewEC2()
+	vpcID := ec2Client.AddVPC("10.0.0.0/16")
+	azs := []string{"eu-west-1a", "eu-west-1b"}
+
+	var subnets capa.Subnets
+	for _, az := range azs {
+		subnets = append(subnets, &capa.SubnetSpec{
+			ID:               "subnet-" + az,
+			AvailabilityZone: az,
+			CidrBlock:        "10.0.0.0/24",
+			RouteTableID:     aws.String(ec2Client.AddRouteTable(vpcID)),
+		})
+	}
+
+	// EC2 is served over HTTP so the operator creates the AWS session from the cluster identity as in production
+	ec2Server := httptest.NewServer(ec2Client)
+	defer ec2Server.Close()
+
+	stop := startManager(t, []scope.ServiceEndpoint{{ServiceID: "ec2", URL: ec2Server.URL, SigningRegion: "eu-west-1"}})
+	defer close(stop)
+
+	// static identity with the credentials the EC2 requests have to be signed with
+	err := mcClient.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testIdentityName,
+			Namespace: testNamespace,
+		},
+		Data: map[string][]byte{
+			"AccessKeyID":     []byte(testAccessKeyID),
+			"SecretAccessKey": []byte("secret"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mcClient.Create(ctx, &capa.AWSClusterStaticIdentity{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testIdentityName,
+		},
+		Spec: capa.AWSClusterStaticIdentitySpec{
+			AWSClusterIdentitySpec: capa.AWSClusterIdentitySpec{
+				AllowedNamespaces: &capa.AllowedNamespaces{},
+			},
+			SecretRef: corev1.SecretReference{Name: testIdentityName, Namespace: testNamespace},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// workload cluster kubeconfig, CAPI Cluster and the AWSCluster with the network CAPA reconciled
+	kubeconfig, err := wcKubeconfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mcClient.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.KubeconfigSecretName(testClusterName),
+			Namespace: testNamespace,
+			Labels:    map[string]string{key.ClusterNameLabel: testClusterName},
+		},
+		Data: map[string][]byte{key.KubeconfigSecretKey: kubeconfig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := &capi.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testClusterName,
+			Namespace: testNamespace,
+		},
+	}
+	err = mcClient.Create(ctx, cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	awsCluster := &capa.AWSCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testClusterName,
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				key.ClusterNameLabel:        testClusterName,
+				key.ClusterWatchFilterLabel: "capi",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: capi.GroupVersion.String(),
+					Kind:       "Cluster",
+					Name:       cluster.Name,
+					UID:        cluster.UID,
+				},
+			},
+		},
+		Spec: capa.AWSClusterSpec{
+			NetworkSpec: capa.NetworkSpec{
+				VPC:     capa.VPCSpec{ID: vpcID},
+				Subnets: subnets,
+			},
+			Region: "eu-west-1",
+			IdentityRef: &capa.AWSIdentityReference{
+				Kind: capa.ClusterStaticIdentityKind,
+				Name: testIdentityName,
+			},
+		},
+	}
+	err = mcClient.Create(ctx, awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the controller might already be patching the conditions, so the status is patched instead of updated
+	statusPatch := client.MergeFrom(awsCluster.DeepCopy())
+	awsCluster.Status.Network.SecurityGroups = map[capa.SecurityGroupRole]capa.SecurityGroup{
+		key.CNINodeSecurityGroupName: {ID: "sg-0123456789abcdef0"},
+	}
+	err = mcClient.Status().Patch(ctx, awsCluster, statusPatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ENIConfigs are applied to the workload cluster and the AWSCluster is ready
+	err = wait.PollImmediate(time.Second, testTimeout, func() (bool, error) {
+		var eniConfigs eniv1alpha1.ENIConfigList
+		err := wcClient.List(ctx, &eniConfigs)
+		if err != nil {
+			return false, err
+		}
+		return len(eniConfigs.Items) == len(azs), nil
+	})
+	if err != nil {
+		t.Fatalf("expected %d ENIConfigs in workload cluster: %s", len(azs), err)
+	}
+
+	awsClusterKey := types.NamespacedName{Namespace: testNamespace, Name: testClusterName}
+	err = wait.PollImmediate(time.Second, testTimeout, func() (bool, error) {
+		err := mcClient.Get(ctx, awsClusterKey, awsCluster)
+		if err != nil {
+			return false, err
+		}
+		return conditions.IsTrue(awsCluster, key.AWSCNIReadyCondition), nil
+	})
+	if err != nil {
+		t.Fatalf("expected %s condition to be true: %s", key.AWSCNIReadyCondition, err)
+	}
+	if !key.HasFinalizer(awsCluster.Finalizers) {
+		t.Fatalf("expected finalizer %s on AWSCluster", key.FinalizerName)
+	}
+	if len(ec2Client.Subnets(vpcID)) != len(azs) {
+		t.Fatalf("expected %d cni subnets, got %d", len(azs), len(ec2Client.Subnets(vpcID)))
+	}
+	if !reflect.DeepEqual(ec2Client.AccessKeyIDs(), []string{testAccessKeyID}) {
+		t.Fatalf("expected EC2 requests signed with the identity access key %s, got %v", testAccessKeyID, ec2Client.AccessKeyIDs())
+	}
+
+	// deletion cleans up ENIConfigs and CNI subnets before the finalizer is removed
+	err = mcClient.Delete(ctx, awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wait.PollImmediate(time.Second, testTimeout, func() (bool, error) {
+		err := mcClient.Get(ctx, awsClusterKey, &capa.AWSCluster{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		t.Fatalf("expected AWSCluster to be deleted once the finalizer is removed: %s", err)
+	}
+
+	var eniConfigs eniv1alpha1.ENIConfigList
+	err = wcClient.List(ctx, &eniConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eniConfigs.Items) != 0 {
+		t.Fatalf("expected ENIConfigs to be deleted, got %d", len(eniConfigs.Items))
+	}
+	if len(ec2Client.Subnets(vpcID)) != 0 {
+		t.Fatalf("expected cni subnets to be deleted, got %d", len(ec2Client.Subnets(vpcID)))
+	}
+}
+
+// startManager runs the AWSCluster controller against the management cluster API server until stop is closed,
+// the AWS service endpoints point the AWS sessions to stand-in backends
+func startManager(t *testing.T, serviceEndpoints []scope.ServiceEndpoint) chan struct{} {
+	mgr, err := ctrl.NewManager(mcEnv.Config, ctrl.Options{
+		Scheme:             mcScheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wcClients, err := wcclient.NewCache(wcclient.CacheConfig{
+		CtrlClient: mgr.GetClient(),
+		Log:        ctrllog.NullLogger{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&AWSClusterReconciler{
+		Client:                 mgr.GetClient(),
+		APIReader:              mgr.GetAPIReader(),
+		APIVersion:             key.V1alpha3APIVersion,
+		DefaultCNICIDR:         "100.64.0.0/16",
+		ServiceEndpoints:       serviceEndpoints,
+		SubnetFreeIPsThreshold: 100,
+		WatchFilterValue:       "capi",
+		WCClients:              wcClients,
+		Log:                    ctrllog.NullLogger{},
+		Scheme:                 mgr.GetScheme(),
+	}).SetupWithManager(mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		err := mgr.Start(stop)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	return stop
+}
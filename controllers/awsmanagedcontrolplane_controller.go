@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	awsclientaws "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	eks "sigs.k8s.io/cluster-api-provider-aws/controlplane/eks/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/awsclient"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/wcclient"
+)
+
+// AWSManagedControlPlaneReconciler reconciles CNI resources of EKS clusters
+type AWSManagedControlPlaneReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// APIVersion is the served version of the Cluster API and CAPA APIs, v1alpha3 is used when empty
+	APIVersion string
+	// APIReader reads CNI CIDRs of other clusters from the API server when allocating from the pool
+	APIReader client.Reader
+	// CAPANamespace is the namespace of the CAPA controller with secrets of v1beta1 static identities
+	CAPANamespace   string
+	CNICIDRPool     string
+	CNICIDRMaskSize int
+	DefaultCNICIDR  string
+	// SubnetFreeIPsThreshold is the number of free IPs in a CNI subnet below which a warning is reported
+	SubnetFreeIPsThreshold int64
+	// ServiceEndpoints replace the default AWS service endpoints, e.g. to run the reconciler against a stand-in EC2 backend
+	ServiceEndpoints []scope.ServiceEndpoint
+	// WatchFilterValue is the value of the watch-filter label AWSManagedControlPlanes must have to be reconciled
+	WatchFilterValue string
+	// WCClients caches workload cluster k8s clients
+	WCClients *wcclient.Cache
+}
+
+//+kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=awsmanagedcontrolplanes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=awsmanagedcontrolplanes/status,verbs=get;update;patch
+
+func (r *AWSManagedControlPlaneReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.TODO()
+	logger := r.Log.WithValues("namespace", req.Namespace, "awsManagedControlPlane", req.Name)
+
+	var cluster cniCluster = &managedControlPlaneAdapter{controlPlane: &eks.AWSManagedControlPlane{}}
+	if r.APIVersion == key.V1beta1APIVersion {
+		cluster = &managedControlPlaneV1beta1Adapter{controlPlane: &v1beta1.AWSManagedControlPlane{}}
+	}
+	err := r.Get(ctx, req.NamespacedName, cluster.object())
+	if k8serrors.IsNotFound(err) {
+		// CR is gone, stop reconciling
+		return ctrl.Result{
+			Requeue: false,
+		}, nil
+	} else if err != nil {
+		logger.Error(err, "failed fetching AWSManagedControlPlane CR")
+		return ctrl.Result{}, err
+	}
+
+	cniReconciler := &cniReconciler{
+		Client:                 r.Client,
+		apiVersion:             r.APIVersion,
+		apiReader:              r.APIReader,
+		capaNamespace:          r.CAPANamespace,
+		cniCIDRPool:            r.CNICIDRPool,
+		cniCIDRMaskSize:        r.CNICIDRMaskSize,
+		defaultCNICIDR:         r.DefaultCNICIDR,
+		eksEnabled:             true,
+		subnetFreeIPsThreshold: r.SubnetFreeIPsThreshold,
+		serviceEndpoints:       r.ServiceEndpoints,
+		wcClients:              r.WCClients,
+	}
+	return cniReconciler.reconcile(ctx, cluster, logger)
+}
+
+// managedControlPlaneAdapter adapts AWSManagedControlPlane to the shared CNI reconciliation
+type managedControlPlaneAdapter struct {
+	controlPlane *eks.AWSManagedControlPlane
+}
+
+func (a *managedControlPlaneAdapter) object() conditions.Setter {
+	return a.controlPlane
+}
+
+func (a *managedControlPlaneAdapter) kind() string {
+	return "AWSManagedControlPlane"
+}
+
+func (a *managedControlPlaneAdapter) networkSpec() capa.NetworkSpec {
+	return a.controlPlane.Spec.NetworkSpec
+}
+
+func (a *managedControlPlaneAdapter) securityGroups() map[capa.SecurityGroupRole]capa.SecurityGroup {
+	return a.controlPlane.Status.Network.SecurityGroups
+}
+
+func (a *managedControlPlaneAdapter) additionalTags() capa.Tags {
+	return a.controlPlane.Spec.AdditionalTags
+}
+
+func (a *managedControlPlaneAdapter) kubeconfigSecretName(clusterName string) string {
+	return key.UserKubeconfigSecretName(clusterName)
+}
+
+func (a *managedControlPlaneAdapter) paused(ctx context.Context, ctrlClient client.Client) (bool, error) {
+	return ownerClusterPaused(ctx, ctrlClient, a.controlPlane)
+}
+
+func (a *managedControlPlaneAdapter) awsSession(ctx context.Context, awsClientGetter *awsclient.AwsClient) (awsclientaws.ConfigProvider, error) {
+	return awsClientGetter.GetManagedControlPlaneAWSClientSession(ctx, a.controlPlane)
+}
+
+// managedControlPlaneV1beta1Adapter adapts v1beta1 AWSManagedControlPlane to the shared CNI reconciliation
+type managedControlPlaneV1beta1Adapter struct {
+	controlPlane *v1beta1.AWSManagedControlPlane
+}
+
+func (a *managedControlPlaneV1beta1Adapter) object() conditions.Setter {
+	return a.controlPlane
+}
+
+func (a *managedControlPlaneV1beta1Adapter) kind() string {
+	return "AWSManagedControlPlane"
+}
+
+func (a *managedControlPlaneV1beta1Adapter) networkSpec() capa.NetworkSpec {
+	return a.controlPlane.Spec.NetworkSpec
+}
+
+func (a *managedControlPlaneV1beta1Adapter) securityGroups() map[capa.SecurityGroupRole]capa.SecurityGroup {
+	return a.controlPlane.Status.Network.SecurityGroups
+}
+
+func (a *managedControlPlaneV1beta1Adapter) additionalTags() capa.Tags {
+	return a.controlPlane.Spec.AdditionalTags
+}
+
+func (a *managedControlPlaneV1beta1Adapter) kubeconfigSecretName(clusterName string) string {
+	return key.UserKubeconfigSecretName(clusterName)
+}
+
+func (a *managedControlPlaneV1beta1Adapter) paused(ctx context.Context, ctrlClient client.Client) (bool, error) {
+	return v1beta1OwnerClusterPaused(ctx, ctrlClient, a.controlPlane)
+}
+
+func (a *managedControlPlaneV1beta1Adapter) awsSession(ctx context.Context, awsClientGetter *awsclient.AwsClient) (awsclientaws.ConfigProvider, error) {
+	return awsClientGetter.GetV1beta1ManagedControlPlaneAWSClientSession(ctx, a.controlPlane)
+}
+
+// awsCNIConfigToAWSManagedControlPlane maps AWSCNIConfig to the AWSManagedControlPlane of the same cluster
+func (r *AWSManagedControlPlaneReconciler) awsCNIConfigToAWSManagedControlPlane(o handler.MapObject) []reconcile.Request {
+	return r.controlPlaneRequests(o.Meta.GetNamespace(), o.Meta.GetLabels()[key.ClusterNameLabel])
+}
+
+// clusterToAWSManagedControlPlane maps CAPI Cluster to the AWSManagedControlPlane of the cluster
+func (r *AWSManagedControlPlaneReconciler) clusterToAWSManagedControlPlane(o handler.MapObject) []reconcile.Request {
+	return r.controlPlaneRequests(o.Meta.GetNamespace(), o.Meta.GetName())
+}
+
+// kubeconfigSecretToAWSManagedControlPlane maps the <cluster>-user-kubeconfig Secret to the AWSManagedControlPlane of the cluster
+func (r *AWSManagedControlPlaneReconciler) kubeconfigSecretToAWSManagedControlPlane(o handler.MapObject) []reconcile.Request {
+	clusterName := o.Meta.GetLabels()[key.ClusterNameLabel]
+	if clusterName == "" {
+		clusterName = strings.TrimSuffix(o.Meta.GetName(), key.UserKubeconfigSecretName(""))
+	}
+	if o.Meta.GetName() != key.UserKubeconfigSecretName(clusterName) {
+		return nil
+	}
+
+	return r.controlPlaneRequests(o.Meta.GetNamespace(), clusterName)
+}
+
+// controlPlaneRequests returns reconcile requests for AWSManagedControlPlanes labeled with the cluster name
+// in the namespace which match the watch filter
+func (r *AWSManagedControlPlaneReconciler) controlPlaneRequests(namespace string, clusterName string) []reconcile.Request {
+	if clusterName == "" {
+		return nil
+	}
+
+	labels := client.MatchingLabels{key.ClusterNameLabel: clusterName}
+	if r.WatchFilterValue != "" {
+		labels[key.ClusterWatchFilterLabel] = r.WatchFilterValue
+	}
+
+	var controlPlaneList runtime.Object = &eks.AWSManagedControlPlaneList{}
+	if r.APIVersion == key.V1beta1APIVersion {
+		controlPlaneList = &v1beta1.AWSManagedControlPlaneList{}
+	}
+	err := r.List(context.TODO(),
+		controlPlaneList,
+		client.InNamespace(namespace),
+		labels,
+	)
+	if err != nil {
+		r.Log.Error(err, "failed to list AWSManagedControlPlanes", "namespace", namespace, "cluster", clusterName)
+		return nil
+	}
+
+	requests, err := listRequests(controlPlaneList)
+	if err != nil {
+		r.Log.Error(err, "failed to read AWSManagedControlPlanes", "namespace", namespace, "cluster", clusterName)
+		return nil
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *AWSManagedControlPlaneReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := controller.New("awsmanagedcontrolplane", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	var controlPlane runtime.Object = &eks.AWSManagedControlPlane{}
+	if r.APIVersion == key.V1beta1APIVersion {
+		controlPlane = &v1beta1.AWSManagedControlPlane{}
+	}
+
+	// AWSManagedControlPlanes without the watch-filter label are never queued
+	err = c.Watch(
+		&source.Kind{Type: controlPlane},
+		&handler.EnqueueRequestForObject{},
+		hasWatchFilterLabel(r.WatchFilterValue),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(
+		&source.Kind{Type: &v1alpha1.AWSCNIConfig{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.awsCNIConfigToAWSManagedControlPlane)},
+	)
+	if err != nil {
+		return err
+	}
+
+	// reconcile as soon as the cluster infrastructure or control plane becomes ready
+	err = c.Watch(
+		&source.Kind{Type: clusterType(r.APIVersion)},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.clusterToAWSManagedControlPlane)},
+		clusterReadinessChanged(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// reconcile as soon as the WC kubeconfig is created or rotated
+	err = c.Watch(
+		&source.Kind{Type: &corev1.Secret{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.kubeconfigSecretToAWSManagedControlPlane)},
+		kubeconfigSecretChanged(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
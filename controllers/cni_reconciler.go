@@ -0,0 +1,672 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	awsclientaws "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/go-logr/logr"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/awsclient"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cidr"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/metrics"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/record"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/wcclient"
+)
+
+// cniCluster adapts the object which describes the cluster network, e.g. AWSCluster or AWSManagedControlPlane,
+// to the CNI reconciliation shared by all cluster kinds
+type cniCluster interface {
+	// object returns the reconciled object, it carries the CNI conditions, annotations and the finalizer
+	object() conditions.Setter
+	// kind returns the kind of the reconciled object for log messages and conditions
+	kind() string
+	networkSpec() capa.NetworkSpec
+	securityGroups() map[capa.SecurityGroupRole]capa.SecurityGroup
+	additionalTags() capa.Tags
+	// kubeconfigSecretName returns the name of the Secret with the WC kubeconfig
+	kubeconfigSecretName(clusterName string) string
+	// paused returns true when the object or the Cluster owning it is paused
+	paused(ctx context.Context, ctrlClient client.Client) (bool, error)
+	awsSession(ctx context.Context, awsClientGetter *awsclient.AwsClient) (awsclientaws.ConfigProvider, error)
+}
+
+// cniReconciler reconciles CNI resources of a cluster independently of the kind of the cluster object
+type cniReconciler struct {
+	client.Client
+
+	// apiVersion is the served version of the Cluster API and CAPA APIs, the CIDR allocator lists clusters in it
+	apiVersion string
+	// apiReader reads CNI CIDRs of other clusters bypassing the cache when allocating from the pool
+	apiReader client.Reader
+	// capaNamespace is the namespace of the CAPA controller with secrets of v1beta1 static identities
+	capaNamespace   string
+	cniCIDRPool     string
+	cniCIDRMaskSize int
+	defaultCNICIDR  string
+	// eksEnabled makes the CIDR allocator reserve CNI CIDRs of EKS clusters as well
+	eksEnabled             bool
+	subnetFreeIPsThreshold int64
+	serviceEndpoints       []scope.ServiceEndpoint
+	wcClients              *wcclient.Cache
+}
+
+func (r *cniReconciler) reconcile(ctx context.Context, cluster cniCluster, logger logr.Logger) (_ ctrl.Result, reterr error) {
+	var err error
+	obj := cluster.object()
+
+	clusterName := key.GetClusterIDFromLabels(obj)
+	logger = logger.WithValues("cluster", clusterName)
+
+	patchHelper, err := patch.NewHelper(obj, r.Client)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("failed to create patch helper for %s", cluster.kind()))
+		return ctrl.Result{}, err
+	}
+	defer func() {
+		if reason := reconcileOutcome(obj, reterr); reason != "" {
+			metrics.ObserveReconcileOutcome(reason)
+		}
+
+		// finalizer is removed once all resources are deleted and the CR might be already gone
+		if obj.GetDeletionTimestamp() != nil && !key.HasFinalizer(obj.GetFinalizers()) {
+			return
+		}
+		err := patchHelper.Patch(ctx, obj, patch.WithOwnedConditions{Conditions: []capi.ConditionType{key.AWSCNIReadyCondition, key.CNISubnetCapacityCondition, key.CNISubnetsDrainedCondition, key.CNIReconciliationPausedCondition}})
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("failed to patch %s conditions", cluster.kind()))
+			reterr = kerrors.NewAggregate([]error{reterr, err})
+		}
+	}()
+
+	paused, err := cluster.paused(ctx, r.Client)
+	if err != nil {
+		logger.Error(err, "failed to get owner Cluster")
+		return ctrl.Result{}, err
+	}
+
+	// paused clusters are left untouched, including deletion, unpausing triggers a new reconciliation
+	if paused {
+		logger.Info("cluster is paused, skipping reconciliation")
+		conditions.MarkTrue(obj, key.CNIReconciliationPausedCondition)
+		return ctrl.Result{}, nil
+	}
+	conditions.Delete(obj, key.CNIReconciliationPausedCondition)
+
+	networkSpec := cluster.networkSpec()
+	// object changes trigger a new reconciliation, so there is no need to requeue while waiting for the network
+	if networkSpec.VPC.ID == "" {
+		logger.Info(fmt.Sprintf("%s does not have vpc id set yet", cluster.kind()))
+		conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForVPCReason, capi.ConditionSeverityInfo, "%s does not have vpc id set yet", cluster.kind())
+		return ctrl.Result{}, nil
+	}
+
+	if len(networkSpec.Subnets.GetUniqueZones()) == 0 {
+		logger.Info(fmt.Sprintf("%s does not have subnets set yet", cluster.kind()))
+		conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForSubnetsReason, capi.ConditionSeverityInfo, "%s does not have subnets set yet", cluster.kind())
+		return ctrl.Result{}, nil
+	}
+
+	cniSecurityGroup, ok := cluster.securityGroups()[key.CNINodeSecurityGroupName]
+	if !ok {
+		logger.Info(fmt.Sprintf("%s does not have security group ready yet", cluster.kind()))
+		conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForSecurityGroupReason, capi.ConditionSeverityInfo, "%s does not have %s security group ready yet", cluster.kind(), key.CNINodeSecurityGroupName)
+		return ctrl.Result{}, nil
+	}
+
+	var awsClientGetter *awsclient.AwsClient
+	{
+		c := awsclient.AWSClientConfig{
+			CAPANamespace: r.capaNamespace,
+			ClusterName:   clusterName,
+			CtrlClient:    r.Client,
+			Endpoints:     r.serviceEndpoints,
+			Log:           logger,
+		}
+		awsClientGetter, err = awsclient.New(c)
+		if err != nil {
+			logger.Error(err, "failed to generate awsClientGetter")
+			return ctrl.Result{}, err
+		}
+	}
+
+	awsClientSession, err := cluster.awsSession(ctx, awsClientGetter)
+	if err != nil {
+		logger.Error(err, "Failed to get aws client session")
+		return ctrl.Result{}, err
+	}
+
+	// optional per cluster CNI settings
+	awsCNIConfig, err := key.GetAWSCNIConfig(ctx, r.Client, clusterName, obj.GetNamespace())
+	if err != nil {
+		logger.Error(err, "failed to get AWSCNIConfig")
+		return ctrl.Result{}, err
+	}
+
+	// CNI CIDR can be set per cluster via AWSCNIConfig or annotation, otherwise we allocate it from the pool or use the default
+	cniCIDR := key.GetCNICIDRFromAnnotations(obj)
+	if awsCNIConfig != nil && awsCNIConfig.Spec.CIDR != "" {
+		cniCIDR = awsCNIConfig.Spec.CIDR
+	} else if cniCIDR == "" && r.cniCIDRPool != "" && obj.GetDeletionTimestamp() == nil && !usesExistingSubnets(awsCNIConfig) {
+		allocator, err := r.newCIDRAllocator(awsClientSession, logger)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		// the allocator saves the CIDR on the object so it stays stable across reconciliations
+		cniCIDR, err = allocator.Allocate(ctx, obj, networkSpec.VPC.ID)
+		if err != nil {
+			conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.CIDRAllocationFailedReason, capi.ConditionSeverityWarning, "%s", err.Error())
+			return ctrl.Result{}, err
+		}
+	} else if cniCIDR == "" {
+		cniCIDR = r.defaultCNICIDR
+	}
+
+	var cniService *cni.CNIService
+	// config for the CNI service
+	config := cni.CNIConfig{
+		AWSSession:         awsClientSession,
+		ClusterName:        clusterName,
+		ClusterTags:        cluster.additionalTags(),
+		CNISecurityGroupID: cniSecurityGroup.ID,
+		CtrlClient:         nil, // we need wc k8s client for resource creation, for deletion it is optional as it might not be avaiable when cluster is being deleted
+		CNICIDR:            cniCIDR,
+		EventObject:        obj,
+		Log:                logger,
+		RouteTableIDs:      key.GetPrivateRouteTableIDs(networkSpec.Subnets),
+		VPCAzList:          networkSpec.Subnets.GetUniqueZones(),
+		VPCID:              networkSpec.VPC.ID,
+	}
+	config.AdditionalCNICIDRs = key.GetAdditionalCNICIDRsFromAnnotations(obj)
+	if awsCNIConfig != nil {
+		config.AdditionalSecurityGroupIDs = awsCNIConfig.Spec.SecurityGroupIDs
+		config.AdditionalTags = awsCNIConfig.Spec.Tags
+		config.ENIConfigAnnotations = awsCNIConfig.Spec.ENIConfig.Annotations
+		config.ENIConfigLabels = awsCNIConfig.Spec.ENIConfig.Labels
+		if awsCNIConfig.Spec.SubnetMaskSize != nil {
+			config.SubnetMaskSize = *awsCNIConfig.Spec.SubnetMaskSize
+		}
+		config.ExistingSubnets = existingSubnets(awsCNIConfig)
+	}
+	config.LastAppliedTags, err = key.GetLastAppliedTagsFromAnnotations(obj)
+	if err != nil {
+		logger.Error(err, "failed to parse last applied tags, tags removed from the cluster will be kept on CNI subnets")
+	}
+
+	kubeconfigSecretName := cluster.kubeconfigSecretName(clusterName)
+
+	logger.Info("reconciling CR")
+	// delete CNI resource
+	if obj.GetDeletionTimestamp() != nil {
+		// wc k8s client is only used to clean up ENIConfigs
+		wcClient, err := r.wcClients.GetFromSecret(ctx, clusterName, obj.GetNamespace(), kubeconfigSecretName)
+		if err != nil {
+			logger.Info(fmt.Sprintf("WC k8s api client is not available, ENIConfigs will not be deleted: %s", err))
+		} else {
+			config.CtrlClient = wcClient
+		}
+
+		cniService, err = cni.New(config)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.DeletingReason, capi.ConditionSeverityInfo, "")
+		err = cniService.Delete()
+		if after, ok := requeueAfter(err); ok {
+			// the deletion is blocked by resources the operator does not own, e.g. subnets in the CNI CIDR
+			conditions.MarkFalse(obj, key.AWSCNIReadyCondition, cni.Reason(err), capi.ConditionSeverityWarning, "%s", err.Error())
+			return ctrl.Result{
+				Requeue:      true,
+				RequeueAfter: after,
+			}, nil
+		} else if err != nil {
+			conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.DeletionFailedReason, capi.ConditionSeverityWarning, "%s", err.Error())
+			return ctrl.Result{}, err
+		}
+		metrics.DeleteCNISubnets(obj.GetNamespace(), clusterName)
+		metrics.DeleteCNISubnetAvailableIPs(obj.GetNamespace(), clusterName, nil)
+		// drop the cached client so a cluster recreated with the same name gets a fresh one
+		r.wcClients.Invalidate(clusterName, obj.GetNamespace())
+
+		err = r.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, obj)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("failed to fetch latest %s", cluster.kind()))
+			return ctrl.Result{}, err
+		}
+		if key.HasFinalizer(obj.GetFinalizers()) {
+			objPatch := client.MergeFrom(obj.DeepCopyObject())
+			controllerutil.RemoveFinalizer(obj, key.FinalizerName)
+			err = r.Patch(ctx, obj, objPatch)
+			if err != nil {
+				logger.Error(err, fmt.Sprintf("failed to remove finalizer on %s", cluster.kind()))
+				return ctrl.Result{}, err
+			}
+		}
+		// all resources were deleted, we dont have to reconcile anymore
+		return ctrl.Result{
+			Requeue: false,
+		}, nil
+	} else { // create CNI resource
+		wcClient, err := r.wcClients.GetFromSecret(ctx, clusterName, obj.GetNamespace(), kubeconfigSecretName)
+		if k8serrors.IsNotFound(err) {
+			// the kubeconfig secret creation triggers a new reconciliation
+			logger.Info("WC k8s api secrets are not ready yet")
+			conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForWorkloadAPIReason, capi.ConditionSeverityInfo, "WC k8s api secrets are not ready yet")
+			return ctrl.Result{}, nil
+		} else if cni.IsAPINotReady(err) {
+			logger.Info(fmt.Sprintf("WC k8s api is not ready yet: %s", err))
+			conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForWorkloadAPIReason, capi.ConditionSeverityInfo, "WC k8s api is not ready yet")
+			return ctrl.Result{
+				Requeue:      true,
+				RequeueAfter: time.Minute,
+			}, nil
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+		config.CtrlClient = wcClient
+		cniService, err = cni.New(config)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if !key.HasFinalizer(obj.GetFinalizers()) {
+			objPatch := client.MergeFrom(obj.DeepCopyObject())
+			controllerutil.AddFinalizer(obj, key.FinalizerName)
+			err = r.Patch(ctx, obj, objPatch)
+			if err != nil {
+				logger.Error(err, fmt.Sprintf("failed to add finalizer on %s", cluster.kind()))
+				return ctrl.Result{}, err
+			}
+		}
+		cniSubnets, err := cniService.Reconcile()
+		if err != nil {
+			markCNINotReady(obj, err)
+		}
+		if !usesExistingSubnets(awsCNIConfig) {
+			setLastAppliedTags(obj, config.LastAppliedTags, cniService.AdditionalSubnetTags(), err == nil)
+		}
+		if cniSubnets != nil {
+			metrics.SetCNISubnets(obj.GetNamespace(), clusterName, len(cniSubnets))
+			checkSubnetCapacity(obj, clusterName, cniSubnets, r.subnetFreeIPsThreshold)
+		}
+		if awsCNIConfig != nil {
+			// the status is informational only, failing to save it must not hide the result of the reconciliation
+			statusErr := updateAWSCNIConfigStatus(ctx, r.Client, awsCNIConfig, cniCIDR, config.AdditionalCNICIDRs, cniSubnets, err == nil)
+			if statusErr != nil {
+				logger.Error(statusErr, "failed to update AWSCNIConfig status")
+			}
+		}
+		if after, ok := requeueAfter(err); ok {
+			return ctrl.Result{
+				Requeue:      true,
+				RequeueAfter: after,
+			}, nil
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+		markCNIReady(obj)
+		draining := checkSubnetDrain(obj, cniSubnets)
+
+		// capacity of existing subnets is managed by their owner
+		if awsCNIConfig != nil && awsCNIConfig.Spec.Expansion != nil && !usesExistingSubnets(awsCNIConfig) {
+			expanded, err := r.expandCapacity(ctx, cluster, awsCNIConfig.Spec.Expansion, append([]string{cniCIDR}, config.AdditionalCNICIDRs...), cniSubnets, awsClientSession, logger)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if expanded {
+				// reconcile right away to create subnets in the new CIDR
+				return ctrl.Result{
+					Requeue: true,
+				}, nil
+			}
+		}
+
+		// subnets of removed AZs are checked more often so they are deleted soon after they are drained
+		if draining {
+			return ctrl.Result{
+				Requeue:      true,
+				RequeueAfter: time.Minute,
+			}, nil
+		}
+	}
+
+	return ctrl.Result{
+		Requeue:      true,
+		RequeueAfter: time.Minute * 5,
+	}, nil
+}
+
+// ownerClusterPaused returns true when the object or the v1alpha3 Cluster owning it is paused
+func ownerClusterPaused(ctx context.Context, ctrlClient client.Client, obj metav1.Object) (bool, error) {
+	capiCluster, err := util.GetOwnerCluster(ctx, ctrlClient, metav1.ObjectMeta{Namespace: obj.GetNamespace(), OwnerReferences: obj.GetOwnerReferences()})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return false, err
+	}
+	return key.IsPaused(capiCluster, obj), nil
+}
+
+// v1beta1OwnerClusterPaused returns true when the object or the v1beta1 Cluster owning it is paused
+func v1beta1OwnerClusterPaused(ctx context.Context, ctrlClient client.Client, obj metav1.Object) (bool, error) {
+	capiCluster, err := key.GetV1beta1OwnerCluster(ctx, ctrlClient, obj)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return false, err
+	}
+	return key.IsV1beta1Paused(capiCluster, obj), nil
+}
+
+// clusterType returns the CAPI Cluster type of the API version
+func clusterType(apiVersion string) runtime.Object {
+	if apiVersion == key.V1beta1APIVersion {
+		return &v1beta1.Cluster{}
+	}
+	return &capi.Cluster{}
+}
+
+// newCIDRAllocator returns allocator of CNI CIDRs from the configured pool
+func (r *cniReconciler) newCIDRAllocator(awsClientSession awsclientaws.ConfigProvider, logger logr.Logger) (*cidr.Allocator, error) {
+	c := cidr.AllocatorConfig{
+		APIVersion:  r.apiVersion,
+		APIReader:   r.apiReader,
+		AWSSession:  awsClientSession,
+		CtrlClient:  r.Client,
+		DefaultCIDR: r.defaultCNICIDR,
+		EKSEnabled:  r.eksEnabled,
+		Log:         logger,
+		Pool:        r.cniCIDRPool,
+		MaskSize:    r.cniCIDRMaskSize,
+	}
+	allocator, err := cidr.New(c)
+	if err != nil {
+		logger.Error(err, "failed to generate cidr allocator")
+		return nil, err
+	}
+	return allocator, nil
+}
+
+// expandCapacity will add another CNI CIDR to the cluster once any active CNI subnet
+// is used above the threshold of the expansion policy, it returns true if a CIDR was added
+func (r *cniReconciler) expandCapacity(ctx context.Context, cluster cniCluster, policy *v1alpha1.ExpansionPolicy, cniCIDRs []string, cniSubnets []cni.CNISubnet, awsClientSession awsclientaws.ConfigProvider, logger logr.Logger) (bool, error) {
+	obj := cluster.object()
+
+	threshold := float64(policy.UtilizationThreshold)
+	if threshold == 0 {
+		threshold = key.DefaultExpansionUtilizationThreshold
+	}
+	maxAdditionalCIDRs := policy.MaxAdditionalCIDRs
+	if maxAdditionalCIDRs == 0 {
+		maxAdditionalCIDRs = key.DefaultExpansionMaxAdditionalCIDRs
+	}
+
+	var exhausted *cni.CNISubnet
+	for i, s := range cniSubnets {
+		if s.Active && s.UsedIPsPercentage() >= threshold {
+			exhausted = &cniSubnets[i]
+			break
+		}
+	}
+	if exhausted == nil {
+		return false, nil
+	}
+
+	additionalCIDRs := key.GetAdditionalCNICIDRsFromAnnotations(obj)
+	if len(additionalCIDRs) >= maxAdditionalCIDRs {
+		logger.Info(fmt.Sprintf("cni subnet %s is %.0f%% used but cluster already has %d additional CNI CIDRs", exhausted.SubnetID, exhausted.UsedIPsPercentage(), len(additionalCIDRs)))
+		return false, nil
+	}
+
+	// pick next CIDR from the policy or allocate it from the pool
+	var nextCIDR string
+	for _, c := range policy.CIDRs {
+		used := false
+		for _, u := range cniCIDRs {
+			if c == u {
+				used = true
+				break
+			}
+		}
+		if !used {
+			nextCIDR = c
+			break
+		}
+	}
+	if nextCIDR != "" {
+		// persist additional CIDR on the object so it stays stable across reconciliations
+		objPatch := client.MergeFrom(obj.DeepCopyObject())
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key.CNIAdditionalCIDRsAnnotation] = strings.Join(append(additionalCIDRs, nextCIDR), ",")
+		obj.SetAnnotations(annotations)
+		err := r.Patch(ctx, obj, objPatch)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("failed to save additional CNI CIDR on %s", cluster.kind()))
+			return false, err
+		}
+	} else if r.cniCIDRPool != "" {
+		allocator, err := r.newCIDRAllocator(awsClientSession, logger)
+		if err != nil {
+			return false, err
+		}
+		// the allocator saves the CIDR on the object so it stays stable across reconciliations
+		nextCIDR, err = allocator.AllocateAdditional(ctx, obj, cluster.networkSpec().VPC.ID)
+		if err != nil {
+			record.Warnf(obj, "CapacityExpansionFailed", "Failed to allocate additional CNI CIDR: %s", err)
+			return false, err
+		}
+	} else {
+		logger.Info("no CIDR available for CNI capacity expansion")
+		record.Warnf(obj, "CapacityExpansionFailed", "CNI subnet %s is %.0f%% used but there is no CIDR available for expansion", exhausted.SubnetID, exhausted.UsedIPsPercentage())
+		return false, nil
+	}
+
+	logger.Info(fmt.Sprintf("expanding CNI capacity with CIDR %s", nextCIDR))
+	record.Eventf(obj, key.CapacityExpandedReason, "CNI subnet %s is %.0f%% used, expanding CNI capacity with CIDR %s", exhausted.SubnetID, exhausted.UsedIPsPercentage(), nextCIDR)
+	return true, nil
+}
+
+// updateAWSCNIConfigStatus will patch the AWSCNIConfig status with the CNI subnets of the cluster
+func updateAWSCNIConfigStatus(ctx context.Context, ctrlClient client.Client, awsCNIConfig *v1alpha1.AWSCNIConfig, cniCIDR string, additionalCIDRs []string, cniSubnets []cni.CNISubnet, ready bool) error {
+	statusPatch := client.MergeFrom(awsCNIConfig.DeepCopy())
+
+	var subnets []v1alpha1.SubnetStatus
+	for _, s := range cniSubnets {
+		subnets = append(subnets, v1alpha1.SubnetStatus{
+			Active:           s.Active,
+			AvailabilityZone: s.AZ,
+			CIDRBlock:        s.CIDRBlock,
+			ID:               s.SubnetID,
+		})
+	}
+
+	// no CIDR is associated by the operator for existing subnets
+	if usesExistingSubnets(awsCNIConfig) {
+		cniCIDR = ""
+		additionalCIDRs = nil
+	}
+
+	awsCNIConfig.Status.CIDR = cniCIDR
+	awsCNIConfig.Status.AdditionalCIDRs = additionalCIDRs
+	awsCNIConfig.Status.Subnets = subnets
+	awsCNIConfig.Status.Ready = ready
+
+	return ctrlClient.Status().Patch(ctx, awsCNIConfig, statusPatch)
+}
+
+// usesExistingSubnets returns true when the cluster uses pre-existing CNI subnets instead of subnets created by the operator
+func usesExistingSubnets(awsCNIConfig *v1alpha1.AWSCNIConfig) bool {
+	return awsCNIConfig != nil && len(awsCNIConfig.Spec.ExistingSubnets) > 0
+}
+
+// existingSubnets returns the pre-existing CNI subnets selected in the AWSCNIConfig
+func existingSubnets(awsCNIConfig *v1alpha1.AWSCNIConfig) []cni.ExistingSubnet {
+	var subnets []cni.ExistingSubnet
+	for _, e := range awsCNIConfig.Spec.ExistingSubnets {
+		subnets = append(subnets, cni.ExistingSubnet{
+			AZ:   e.AvailabilityZone,
+			ID:   e.ID,
+			Tags: e.Tags,
+		})
+	}
+	return subnets
+}
+
+// checkSubnetCapacity will report CNI subnets which are running out of free IP addresses
+func checkSubnetCapacity(obj conditions.Setter, clusterName string, cniSubnets []cni.CNISubnet, threshold int64) {
+	var exhausting []string
+	var azs []string
+	for _, s := range cniSubnets {
+		// subnets of older CNI CIDRs are not used for new ENIs anymore
+		if !s.Active {
+			continue
+		}
+		metrics.SetCNISubnetAvailableIPs(obj.GetNamespace(), clusterName, s.AZ, s.AvailableIPs)
+		azs = append(azs, s.AZ)
+
+		if s.AvailableIPs < threshold {
+			exhausting = append(exhausting, fmt.Sprintf("%s (%d free)", s.SubnetID, s.AvailableIPs))
+		}
+	}
+	// AZs removed from the cluster do not have active subnets anymore
+	metrics.DeleteCNISubnetAvailableIPs(obj.GetNamespace(), clusterName, azs)
+
+	if len(exhausting) > 0 {
+		record.Warnf(obj, key.SubnetIPsExhaustingReason, "CNI subnets are running out of IP addresses: %s", strings.Join(exhausting, ", "))
+		conditions.MarkFalse(obj, key.CNISubnetCapacityCondition, key.SubnetIPsExhaustingReason, capi.ConditionSeverityWarning,
+			"CNI subnets have less than %d free IP addresses: %s", threshold, strings.Join(exhausting, ", "))
+	} else {
+		conditions.MarkTrue(obj, key.CNISubnetCapacityCondition)
+	}
+}
+
+// checkSubnetDrain will report CNI subnets of removed AZs which are waiting for their network interfaces to be
+// detached and return true when there are any, the event is only recorded when the subnets start draining
+func checkSubnetDrain(obj conditions.Setter, cniSubnets []cni.CNISubnet) bool {
+	var draining []string
+	for _, s := range cniSubnets {
+		if s.Draining {
+			draining = append(draining, fmt.Sprintf("%s (%s)", s.SubnetID, s.AZ))
+		}
+	}
+
+	if len(draining) == 0 {
+		conditions.MarkTrue(obj, key.CNISubnetsDrainedCondition)
+		return false
+	}
+
+	if !conditions.IsFalse(obj, key.CNISubnetsDrainedCondition) {
+		record.Eventf(obj, "SubnetDrainPending", "CNI subnets of removed AZs are deleted once their network interfaces are detached: %s", strings.Join(draining, ", "))
+	}
+	conditions.MarkFalse(obj, key.CNISubnetsDrainedCondition, key.WaitingForSubnetDrainReason, capi.ConditionSeverityInfo,
+		"CNI subnets of removed AZs still have attached network interfaces: %s", strings.Join(draining, ", "))
+	return true
+}
+
+// setLastAppliedTags stores the additional tags applied to the CNI subnets on the object, when the reconciliation
+// failed the previously applied tags are kept as well because some subnets might still have them
+func setLastAppliedTags(obj metav1.Object, lastApplied map[string]string, applied map[string]string, succeeded bool) {
+	tags := map[string]string{}
+	for k, v := range applied {
+		tags[k] = v
+	}
+	if !succeeded {
+		for k, v := range lastApplied {
+			if _, ok := tags[k]; !ok {
+				tags[k] = v
+			}
+		}
+	}
+
+	annotations := obj.GetAnnotations()
+	if len(tags) == 0 {
+		delete(annotations, key.LastAppliedTagsAnnotation)
+		obj.SetAnnotations(annotations)
+		return
+	}
+
+	// marshaling a string map cannot fail
+	value, _ := json.Marshal(tags)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key.LastAppliedTagsAnnotation] = string(value)
+	obj.SetAnnotations(annotations)
+}
+
+// markCNIReady sets the AWSCNIReady condition to true and records the time to ready when the CNI becomes ready
+// for the first time, later transitions after restarts or transient failures are not observed
+func markCNIReady(obj conditions.Setter) {
+	if _, ok := obj.GetAnnotations()[key.CNIFirstReadyAnnotation]; !ok {
+		// clusters which were already ready before the annotation was introduced are only annotated
+		if !conditions.IsTrue(obj, key.AWSCNIReadyCondition) {
+			metrics.ObserveTimeToReady(obj.GetCreationTimestamp().Time)
+		}
+
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key.CNIFirstReadyAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		obj.SetAnnotations(annotations)
+	}
+
+	conditions.MarkTrue(obj, key.AWSCNIReadyCondition)
+}
+
+// markCNINotReady sets the AWSCNIReady condition to false with the reason of the failed CNI reconcile step
+// reconcileOutcome returns the reason the reconciliation is counted with, failed reconciliations are counted by
+// the reason of their error as the condition might still carry the result of a previous reconciliation
+func reconcileOutcome(obj conditions.Setter, err error) string {
+	if conditions.IsTrue(obj, key.CNIReconciliationPausedCondition) {
+		return key.PausedReason
+	}
+	if err != nil {
+		if reason := cni.Reason(err); reason != "" {
+			return reason
+		}
+		if obj.GetDeletionTimestamp() != nil {
+			return key.DeletionFailedReason
+		}
+		return key.ReconcileFailedReason
+	}
+	if conditions.IsTrue(obj, key.AWSCNIReadyCondition) {
+		return key.ReadyReason
+	}
+	return conditions.GetReason(obj, key.AWSCNIReadyCondition)
+}
+
+func markCNINotReady(obj conditions.Setter, err error) {
+	reason := cni.Reason(err)
+	severity := capi.ConditionSeverityWarning
+
+	switch reason {
+	case "":
+		reason = key.ReconcileFailedReason
+	case key.WaitingForWorkloadAPIReason, key.ENIConfigCRDMissingReason:
+		severity = capi.ConditionSeverityInfo
+	}
+
+	conditions.MarkFalse(obj, key.AWSCNIReadyCondition, reason, severity, "%s", err.Error())
+}
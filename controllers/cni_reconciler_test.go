@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8srecord "k8s.io/client-go/tools/record"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/record"
+)
+
+func Test_CheckSubnetDrain(t *testing.T) {
+	events := k8srecord.NewFakeRecorder(10)
+	record.InitFromRecorder(events)
+
+	testCases := []struct {
+		name string
+		// wasDraining sets the CNISubnetsDrained condition to false before the check
+		wasDraining      bool
+		subnets          []cni.CNISubnet
+		expectedDraining bool
+		expectedEvents   int
+	}{
+		{
+			name:    "case 0: no draining subnets",
+			subnets: []cni.CNISubnet{{AZ: "eu-west-1a", SubnetID: "subnet-1", Active: true}},
+		},
+		{
+			name: "case 1: subnets start draining",
+			subnets: []cni.CNISubnet{
+				{AZ: "eu-west-1a", SubnetID: "subnet-1", Active: true},
+				{AZ: "eu-west-1b", SubnetID: "subnet-2", Draining: true},
+			},
+			expectedDraining: true,
+			expectedEvents:   1,
+		},
+		{
+			name:        "case 2: subnets are still draining",
+			wasDraining: true,
+			subnets: []cni.CNISubnet{
+				{AZ: "eu-west-1a", SubnetID: "subnet-1", Active: true},
+				{AZ: "eu-west-1b", SubnetID: "subnet-2", Draining: true},
+			},
+			expectedDraining: true,
+		},
+		{
+			name:        "case 3: subnets are drained",
+			wasDraining: true,
+			subnets:     []cni.CNISubnet{{AZ: "eu-west-1a", SubnetID: "subnet-1", Active: true}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := &capa.AWSCluster{}
+			if tc.wasDraining {
+				conditions.MarkFalse(obj, key.CNISubnetsDrainedCondition, key.WaitingForSubnetDrainReason, capi.ConditionSeverityInfo, "")
+			}
+			conditions.MarkTrue(obj, key.AWSCNIReadyCondition)
+
+			draining := checkSubnetDrain(obj, tc.subnets)
+			if draining != tc.expectedDraining {
+				t.Fatalf("expected draining %t, got %t", tc.expectedDraining, draining)
+			}
+			if conditions.IsFalse(obj, key.CNISubnetsDrainedCondition) != tc.expectedDraining {
+				t.Fatalf("expected %s condition false %t, got %s", key.CNISubnetsDrainedCondition, tc.expectedDraining, conditions.Get(obj, key.CNISubnetsDrainedCondition).Status)
+			}
+			if tc.expectedDraining && conditions.GetReason(obj, key.CNISubnetsDrainedCondition) != key.WaitingForSubnetDrainReason {
+				t.Fatalf("expected reason %s, got %s", key.WaitingForSubnetDrainReason, conditions.GetReason(obj, key.CNISubnetsDrainedCondition))
+			}
+			// draining subnets of removed AZs do not affect the readiness of the CNI
+			if !conditions.IsTrue(obj, key.AWSCNIReadyCondition) {
+				t.Fatalf("expected %s condition to stay true", key.AWSCNIReadyCondition)
+			}
+
+			if len(events.Events) != tc.expectedEvents {
+				t.Fatalf("expected %d events, got %d", tc.expectedEvents, len(events.Events))
+			}
+			for len(events.Events) > 0 {
+				event := <-events.Events
+				if !strings.HasPrefix(event, corev1.EventTypeNormal) {
+					t.Fatalf("expected normal event, got %s", event)
+				}
+			}
+		})
+	}
+}
+
+func Test_UpdateAWSCNIConfigStatus(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	awsCNIConfig := &v1alpha1.AWSCNIConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec:       v1alpha1.AWSCNIConfigSpec{CIDR: "100.64.0.0/16"},
+	}
+	ctrlClient := fakeclient.NewFakeClientWithScheme(scheme, awsCNIConfig)
+
+	err := ctrlClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "test"}, awsCNIConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spec is changed by the user while the cluster is reconciled
+	latest := awsCNIConfig.DeepCopy()
+	latest.Spec.SecurityGroupIDs = []string{"sg-1"}
+	err = ctrlClient.Update(ctx, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnets := []cni.CNISubnet{{AZ: "eu-west-1a", SubnetID: "subnet-1", CIDRBlock: "100.64.0.0/17", Active: true}}
+	err = updateAWSCNIConfigStatus(ctx, ctrlClient, awsCNIConfig, "100.64.0.0/16", nil, subnets, true)
+	if err != nil {
+		t.Fatalf("expected status patch of outdated object to succeed, got %s", err)
+	}
+
+	err = ctrlClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "test"}, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest.Status.Ready || latest.Status.CIDR != "100.64.0.0/16" || len(latest.Status.Subnets) != 1 || latest.Status.Subnets[0].ID != "subnet-1" {
+		t.Fatalf("expected status with ready subnet subnet-1, got %+v", latest.Status)
+	}
+	if len(latest.Spec.SecurityGroupIDs) != 1 {
+		t.Fatalf("expected spec change to be kept, got %v", latest.Spec.SecurityGroupIDs)
+	}
+}
+
+func Test_ReconcileOutcome(t *testing.T) {
+	testCases := []struct {
+		name string
+		// setup sets the conditions left by the previous reconciliation
+		setup          func(obj *capa.AWSCluster)
+		err            error
+		expectedReason string
+	}{
+		{
+			name:           "case 0: ready",
+			setup:          func(obj *capa.AWSCluster) { conditions.MarkTrue(obj, key.AWSCNIReadyCondition) },
+			expectedReason: key.ReadyReason,
+		},
+		{
+			name: "case 1: not ready without error",
+			setup: func(obj *capa.AWSCluster) {
+				conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.WaitingForWorkloadAPIReason, capi.ConditionSeverityInfo, "")
+			},
+			expectedReason: key.WaitingForWorkloadAPIReason,
+		},
+		{
+			name:           "case 2: error is not counted as ready condition of previous reconciliation",
+			setup:          func(obj *capa.AWSCluster) { conditions.MarkTrue(obj, key.AWSCNIReadyCondition) },
+			err:            errors.New("failed to get WC k8s client"),
+			expectedReason: key.ReconcileFailedReason,
+		},
+		{
+			name: "case 3: error of deleted cluster",
+			setup: func(obj *capa.AWSCluster) {
+				now := metav1.Now()
+				obj.SetDeletionTimestamp(&now)
+				conditions.MarkFalse(obj, key.AWSCNIReadyCondition, key.DeletingReason, capi.ConditionSeverityInfo, "")
+			},
+			err:            errors.New("failed to remove finalizer"),
+			expectedReason: key.DeletionFailedReason,
+		},
+		{
+			name: "case 4: paused",
+			setup: func(obj *capa.AWSCluster) {
+				conditions.MarkTrue(obj, key.CNIReconciliationPausedCondition)
+				conditions.MarkTrue(obj, key.AWSCNIReadyCondition)
+			},
+			expectedReason: key.PausedReason,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := &capa.AWSCluster{}
+			tc.setup(obj)
+
+			reason := reconcileOutcome(obj, tc.err)
+			if reason != tc.expectedReason {
+				t.Fatalf("expected reason %s, got %s", tc.expectedReason, reason)
+			}
+		})
+	}
+}
@@ -1,13 +1,25 @@
 package controllers
 
 import (
-	"strings"
+	"errors"
+	"time"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
 )
 
-// IsAWSCNINotFoundError will assert errors than can be caused by aws-cni not ready yet
-func IsAWSCNINotFoundError(err error) bool {
-	if err != nil && strings.Contains(err.Error(), "aws-cni") {
-		return true
+// requeueAfter returns the interval after which a reconciliation which failed with an error
+// caused by the WC not being ready yet or by subnets of others blocking the CNI CIDR is retried,
+// false is returned for any other error
+func requeueAfter(err error) (time.Duration, bool) {
+	switch {
+	case errors.Is(err, cni.ErrWorkloadAPINotReady):
+		return time.Minute, true
+	case errors.Is(err, cni.ErrENIConfigNotRegistered):
+		return time.Minute * 2, true
+	case errors.Is(err, cni.ErrCIDRInUse):
+		// subnets of others have to be removed manually, so there is no point in retrying with backoff
+		return time.Minute * 10, true
+	default:
+		return 0, false
 	}
-	return false
 }
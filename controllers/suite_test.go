@@ -0,0 +1,214 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	eniv1alpha1 "github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+)
+
+// The suite runs the controllers against two API servers, the management cluster with the Cluster API, CAPA and
+// AWSCNIConfig CRDs and the workload cluster with the ENIConfig CRD. EC2 is the in-memory fake served over HTTP.
+var (
+	// mcEnv and wcEnv are nil when the envtest binaries are not available
+	mcEnv *envtest.Environment
+	wcEnv *envtest.Environment
+
+	mcScheme = runtime.NewScheme()
+	wcScheme = runtime.NewScheme()
+
+	mcClient client.Client
+	wcClient client.Client
+)
+
+func init() {
+	_ = clientgoscheme.AddToScheme(mcScheme)
+	_ = capi.AddToScheme(mcScheme)
+	_ = capa.AddToScheme(mcScheme)
+	_ = v1alpha1.AddToScheme(mcScheme)
+
+	_ = eniv1alpha1.AddToScheme(wcScheme)
+}
+
+func TestMain(m *testing.M) {
+	// etcd and kube-apiserver binaries are required, tests using them are skipped without the binaries,
+	// make test downloads them and sets KUBEBUILDER_ASSETS
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		fmt.Println("KUBEBUILDER_ASSETS is not set, skipping envtest tests")
+		os.Exit(m.Run())
+	}
+
+	err := startEnvironments()
+	if err != nil {
+		fmt.Println(err)
+		stopEnvironments()
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	stopEnvironments()
+	os.Exit(code)
+}
+
+// requireEnvtest skips the test when the envtest API servers are not running
+func requireEnvtest(t *testing.T) {
+	if mcEnv == nil || wcEnv == nil {
+		t.Skip("envtest binaries are not available, set KUBEBUILDER_ASSETS to run this test")
+	}
+}
+
+func startEnvironments() error {
+	var crdPaths []string
+	{
+		crdPaths = append(crdPaths, filepath.Join("..", "config", "crd", "bases"))
+
+		capiDir, err := moduleDir("sigs.k8s.io/cluster-api")
+		if err != nil {
+			return err
+		}
+		capaDir, err := moduleDir("sigs.k8s.io/cluster-api-provider-aws")
+		if err != nil {
+			return err
+		}
+		crdPaths = append(crdPaths,
+			filepath.Join(capiDir, "config", "crd", "bases"),
+			filepath.Join(capaDir, "config", "crd", "bases"),
+		)
+	}
+
+	mcEnv = &envtest.Environment{
+		CRDDirectoryPaths:     crdPaths,
+		ErrorIfCRDPathMissing: true,
+	}
+	mcConfig, err := mcEnv.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start management cluster api server: %w", err)
+	}
+	mcClient, err = client.New(mcConfig, client.Options{Scheme: mcScheme})
+	if err != nil {
+		return err
+	}
+
+	wcEnv = &envtest.Environment{
+		CRDs: []runtime.Object{eniConfigCRD()},
+	}
+	wcConfig, err := wcEnv.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start workload cluster api server: %w", err)
+	}
+	wcClient, err = client.New(wcConfig, client.Options{Scheme: wcScheme})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func stopEnvironments() {
+	for _, env := range []*envtest.Environment{mcEnv, wcEnv} {
+		if env == nil || env.Config == nil {
+			continue
+		}
+		err := env.Stop()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// moduleDir returns the directory of the module in the module cache, CRDs of Cluster API and CAPA are read from it
+func moduleDir(module string) (string, error) {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", module).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find directory of module %s: %w", module, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// wcKubeconfig returns kubeconfig of the workload cluster API server as stored in the <cluster>-kubeconfig Secret
+func wcKubeconfig() ([]byte, error) {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["wc"] = &clientcmdapi.Cluster{
+		Server:                   wcEnv.ControlPlane.APIURL().String(),
+		CertificateAuthorityData: wcEnv.Config.CAData,
+	}
+	config.AuthInfos["wc"] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: wcEnv.Config.CertData,
+		ClientKeyData:         wcEnv.Config.KeyData,
+		Token:                 wcEnv.Config.BearerToken,
+	}
+	config.Contexts["wc"] = &clientcmdapi.Context{Cluster: "wc", AuthInfo: "wc"}
+	config.CurrentContext = "wc"
+
+	return clientcmd.Write(*config)
+}
+
+// eniConfigCRD returns the ENIConfig CRD which is installed by the AWS VPC CNI in workload clusters
+func eniConfigCRD() *apiextensionsv1.CustomResourceDefinition {
+	preserveUnknownFields := true
+
+	return &apiextensionsv1.CustomResourceDefinition{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: apiextensionsv1.SchemeGroupVersion.String(),
+			Kind:       "CustomResourceDefinition",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "eniconfigs.crd.k8s.amazonaws.com",
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: eniv1alpha1.SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Kind:     "ENIConfig",
+				ListKind: "ENIConfigList",
+				Plural:   "eniconfigs",
+				Singular: "eniconfig",
+			},
+			Scope: apiextensionsv1.ClusterScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    eniv1alpha1.SchemeGroupVersion.Version,
+					Served:  true,
+					Storage: true,
+					Schema: &apiextensionsv1.CustomResourceValidation{
+						OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+							Type:                   "object",
+							XPreserveUnknownFields: &preserveUnknownFields,
+						},
+					},
+				},
+			},
+		},
+	}
+}
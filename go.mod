@@ -7,16 +7,20 @@ require (
 	github.com/Azure/go-autorest/autorest v0.11.18 // indirect
 	github.com/aws/amazon-vpc-cni-k8s v1.7.5
 	github.com/aws/aws-sdk-go v1.39.4
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/giantswarm/ipam v0.3.0
 	github.com/go-logr/logr v0.1.0
 	github.com/google/go-cmp v0.5.6 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	k8s.io/api v0.17.9
+	k8s.io/apiextensions-apiserver v0.17.9
 	k8s.io/apimachinery v0.17.9
 	k8s.io/client-go v0.17.9
 	k8s.io/klog v1.0.0
 	sigs.k8s.io/cluster-api v0.3.19
 	sigs.k8s.io/cluster-api-provider-aws v0.6.6
 	sigs.k8s.io/controller-runtime v0.5.14
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
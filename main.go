@@ -17,20 +17,34 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/klog/klogr"
 	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	eks "sigs.k8s.io/cluster-api-provider-aws/controlplane/eks/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/endpoints"
 	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
 	"github.com/giantswarm/capa-aws-cni-operator/controllers"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/record"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/wcclient"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -44,18 +58,44 @@ func init() {
 
 	_ = capi.AddToScheme(scheme)
 	_ = capa.AddToScheme(scheme)
+	_ = eks.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
 	var metricsAddr string
+	var apiVersion string
+	var capaNamespace string
+	var cniCIDRPool string
+	var cniCIDRMaskSize int
 	var defaultCNICIDR string
+	var enableEKS bool
 	var enableLeaderElection bool
 	var probeAddr string
+	var serviceEndpoints string
+	var subnetFreeIPsThreshold int64
+	var watchFilterValue string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&apiVersion, "cluster-api-version", "",
+		"Version of the Cluster API and CAPA APIs to reconcile, v1alpha3 or v1beta1. If empty, the newest version served by the management cluster is used.")
+	flag.StringVar(&capaNamespace, "capa-namespace", "capa-system",
+		"Namespace of the CAPA controller, secrets of v1beta1 AWSClusterStaticIdentities are read from it.")
 	flag.StringVar(&defaultCNICIDR, "default-cni-cidr", "100.64.0.0/16",
 		"Enable creation and management of KIAM role for kiam app.")
+	flag.StringVar(&cniCIDRPool, "cni-cidr-pool", "",
+		"Network from which per cluster CNI CIDRs are allocated, e.g. 100.64.0.0/10. If empty, default-cni-cidr is used for every cluster.")
+	flag.IntVar(&cniCIDRMaskSize, "cni-cidr-mask-size", 16, "Mask size of the CNI CIDR allocated from cni-cidr-pool.")
+	flag.Int64Var(&subnetFreeIPsThreshold, "subnet-free-ips-threshold", 100,
+		"Number of free IP addresses in a CNI subnet below which a warning is reported on the AWSCluster.")
+	flag.StringVar(&serviceEndpoints, "service-endpoints", "",
+		"Custom AWS service endpoints in the CAPA format ${SigningRegion1}:${ServiceID1}=${URL1},${ServiceID2}=${URL2};${SigningRegion2}...")
+	flag.StringVar(&watchFilterValue, "watch-filter", "capi",
+		"Value of the cluster.x-k8s.io/watch-filter label objects must have to be reconciled. If empty, all objects are reconciled.")
+	flag.BoolVar(&enableEKS, "enable-eks", false,
+		"Enable reconciliation of EKS clusters via AWSManagedControlPlane. Requires CAPA EKS control plane CRDs to be installed.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -67,7 +107,46 @@ func main() {
 
 	ctrl.SetLogger(klogr.New())
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	awsServiceEndpoints, err := endpoints.ParseFlag(serviceEndpoints)
+	if err != nil {
+		setupLog.Error(err, "unable to parse service endpoints")
+		os.Exit(1)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+
+	// fail early instead of reconciling against missing APIs
+	apiVersion, err = detectAPIVersion(discoveryClient, apiVersion, enableEKS)
+	if err != nil {
+		setupLog.Error(err, "unsupported Cluster API version")
+		os.Exit(1)
+	}
+	setupLog.Info(fmt.Sprintf("reconciling Cluster API and CAPA %s APIs", apiVersion))
+
+	// v1beta1 objects are decoded into a subset of the types, fail early when CAPA changed their schema
+	if apiVersion == key.V1beta1APIVersion {
+		crdScheme := runtime.NewScheme()
+		_ = apiextensionsv1.AddToScheme(crdScheme)
+		crdClient, err := client.New(restConfig, client.Options{Scheme: crdScheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create CRD client")
+			os.Exit(1)
+		}
+
+		err = checkV1beta1Schemas(context.Background(), crdClient, enableEKS)
+		if err != nil {
+			setupLog.Error(err, "unsupported v1beta1 CRD schemas")
+			os.Exit(1)
+		}
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
@@ -80,15 +159,56 @@ func main() {
 		os.Exit(1)
 	}
 
+	record.InitFromRecorder(mgr.GetEventRecorderFor("capa-aws-cni-operator"))
+
+	wcClients, err := wcclient.NewCache(wcclient.CacheConfig{
+		CtrlClient: mgr.GetClient(),
+		Log:        ctrl.Log.WithName("wcclient"),
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to create wc client cache")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.AWSClusterReconciler{
-		Client:         mgr.GetClient(),
-		DefaultCNICIDR: defaultCNICIDR,
-		Log:            ctrl.Log.WithName("controllers").WithName("AWSCluster"),
-		Scheme:         mgr.GetScheme(),
+		Client:                 mgr.GetClient(),
+		APIReader:              mgr.GetAPIReader(),
+		APIVersion:             apiVersion,
+		CAPANamespace:          capaNamespace,
+		CNICIDRPool:            cniCIDRPool,
+		CNICIDRMaskSize:        cniCIDRMaskSize,
+		DefaultCNICIDR:         defaultCNICIDR,
+		EnableEKS:              enableEKS,
+		ServiceEndpoints:       awsServiceEndpoints,
+		SubnetFreeIPsThreshold: subnetFreeIPsThreshold,
+		WatchFilterValue:       watchFilterValue,
+		WCClients:              wcClients,
+		Log:                    ctrl.Log.WithName("controllers").WithName("AWSCluster"),
+		Scheme:                 mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AWSCluster")
 		os.Exit(1)
 	}
+	if enableEKS {
+		if err = (&controllers.AWSManagedControlPlaneReconciler{
+			Client:                 mgr.GetClient(),
+			APIReader:              mgr.GetAPIReader(),
+			APIVersion:             apiVersion,
+			CAPANamespace:          capaNamespace,
+			CNICIDRPool:            cniCIDRPool,
+			CNICIDRMaskSize:        cniCIDRMaskSize,
+			DefaultCNICIDR:         defaultCNICIDR,
+			ServiceEndpoints:       awsServiceEndpoints,
+			SubnetFreeIPsThreshold: subnetFreeIPsThreshold,
+			WatchFilterValue:       watchFilterValue,
+			WCClients:              wcClients,
+			Log:                    ctrl.Log.WithName("controllers").WithName("AWSManagedControlPlane"),
+			Scheme:                 mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSManagedControlPlane")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -106,3 +226,79 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// detectAPIVersion returns the Cluster API and CAPA version the operator reconciles, it is the requested
+// version or the newest supported version served by the management cluster when none is requested
+func detectAPIVersion(discoveryClient discovery.DiscoveryInterface, requested string, enableEKS bool) (string, error) {
+	candidates := []string{key.V1beta1APIVersion, key.V1alpha3APIVersion}
+	if requested != "" {
+		if requested != key.V1beta1APIVersion && requested != key.V1alpha3APIVersion {
+			return "", fmt.Errorf("unsupported Cluster API version %s, only %s and %s are supported", requested, key.V1alpha3APIVersion, key.V1beta1APIVersion)
+		}
+		candidates = []string{requested}
+	}
+
+	var errs []error
+	for _, version := range candidates {
+		err := checkServedAPIs(discoveryClient, version, enableEKS)
+		if err == nil {
+			return version, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return "", kerrors.NewAggregate(errs)
+}
+
+// checkServedAPIs will return error when the management cluster does not serve
+// the Cluster API and CAPA resources the operator reconciles in the version
+func checkServedAPIs(discoveryClient discovery.DiscoveryInterface, version string, enableEKS bool) error {
+	required := map[schema.GroupVersion]string{
+		{Group: capi.GroupVersion.Group, Version: version}: "clusters",
+		{Group: capa.GroupVersion.Group, Version: version}: "awsclusters",
+	}
+	if enableEKS {
+		required[schema.GroupVersion{Group: eks.GroupVersion.Group, Version: version}] = "awsmanagedcontrolplanes"
+	}
+
+	for gv, resource := range required {
+		resources, err := discoveryClient.ServerResourcesForGroupVersion(gv.String())
+		if err != nil {
+			return fmt.Errorf("management cluster does not serve %s: %w", gv.String(), err)
+		}
+
+		served := false
+		for _, r := range resources.APIResources {
+			if r.Name == resource {
+				served = true
+				break
+			}
+		}
+		if !served {
+			return fmt.Errorf("management cluster does not serve %s in %s", resource, gv.String())
+		}
+	}
+
+	return nil
+}
+
+// checkV1beta1Schemas will return error when the v1beta1 CRDs served by the management cluster
+// do not contain all fields of the types the operator decodes the objects into
+func checkV1beta1Schemas(ctx context.Context, ctrlClient client.Reader, enableEKS bool) error {
+	var errs []error
+	for _, check := range v1beta1.SchemaChecks(enableEKS) {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		err := ctrlClient.Get(ctx, client.ObjectKey{Name: check.CRDName}, crd)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get CRD %s: %w", check.CRDName, err))
+			continue
+		}
+
+		err = check.CheckSchema(crd)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
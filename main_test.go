@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+)
+
+func Test_DetectAPIVersion(t *testing.T) {
+	testCases := []struct {
+		name string
+		// served are the Cluster API and CAPA versions served by the management cluster
+		served []string
+		// servedEKS are the EKS control plane versions served by the management cluster
+		servedEKS       []string
+		requested       string
+		enableEKS       bool
+		expectedVersion string
+		expectError     bool
+	}{
+		{
+			name:            "case 0: v1alpha3 is detected",
+			served:          []string{key.V1alpha3APIVersion},
+			expectedVersion: key.V1alpha3APIVersion,
+		},
+		{
+			name:            "case 1: newest served version is detected",
+			served:          []string{key.V1alpha3APIVersion, key.V1beta1APIVersion},
+			expectedVersion: key.V1beta1APIVersion,
+		},
+		{
+			name:            "case 2: requested version is used",
+			served:          []string{key.V1alpha3APIVersion, key.V1beta1APIVersion},
+			requested:       key.V1alpha3APIVersion,
+			expectedVersion: key.V1alpha3APIVersion,
+		},
+		{
+			name:        "case 3: requested version which is not served fails",
+			served:      []string{key.V1alpha3APIVersion},
+			requested:   key.V1beta1APIVersion,
+			expectError: true,
+		},
+		{
+			name:        "case 4: unsupported requested version fails",
+			served:      []string{key.V1alpha3APIVersion},
+			requested:   "v1alpha4",
+			expectError: true,
+		},
+		{
+			name:        "case 5: no supported version served fails",
+			served:      []string{"v1alpha4"},
+			expectError: true,
+		},
+		{
+			name:            "case 6: EKS control plane is required in the detected version",
+			served:          []string{key.V1alpha3APIVersion, key.V1beta1APIVersion},
+			servedEKS:       []string{key.V1alpha3APIVersion},
+			enableEKS:       true,
+			expectedVersion: key.V1alpha3APIVersion,
+		},
+		{
+			name:        "case 7: missing EKS control plane fails",
+			served:      []string{key.V1beta1APIVersion},
+			enableEKS:   true,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var resources []*metav1.APIResourceList
+			for _, v := range tc.served {
+				resources = append(resources,
+					&metav1.APIResourceList{GroupVersion: "cluster.x-k8s.io/" + v, APIResources: []metav1.APIResource{{Name: "clusters"}}},
+					&metav1.APIResourceList{GroupVersion: "infrastructure.cluster.x-k8s.io/" + v, APIResources: []metav1.APIResource{{Name: "awsclusters"}}},
+				)
+			}
+			for _, v := range tc.servedEKS {
+				resources = append(resources,
+					&metav1.APIResourceList{GroupVersion: "controlplane.cluster.x-k8s.io/" + v, APIResources: []metav1.APIResource{{Name: "awsmanagedcontrolplanes"}}},
+				)
+			}
+			discoveryClient := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: resources}}
+
+			version, err := detectAPIVersion(discoveryClient, tc.requested, tc.enableEKS)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got version %s", version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tc.expectedVersion {
+				t.Fatalf("expected version %s, got %s", tc.expectedVersion, version)
+			}
+		})
+	}
+}
+
+func Test_CheckV1beta1Schemas(t *testing.T) {
+	preserveUnknownFields := true
+	// any schema preserving unknown fields contains all fields
+	permissive := &apiextensionsv1.JSONSchemaProps{Type: "object", XPreserveUnknownFields: &preserveUnknownFields}
+	// v1alpha3 AWSCluster status has the network status in status.network
+	v1alpha3Status := &apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"apiVersion": {Type: "string"},
+			"kind":       {Type: "string"},
+			"spec":       *permissive,
+			"status": {
+				Type: "object",
+				Properties: map[string]apiextensionsv1.JSONSchemaProps{
+					"network":    *permissive,
+					"conditions": {Type: "array"},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		enableEKS bool
+		// schemas are the v1beta1 schemas of the served CRDs
+		schemas     map[string]*apiextensionsv1.JSONSchemaProps
+		expectError bool
+	}{
+		{
+			name: "case 0: matching schemas",
+			schemas: map[string]*apiextensionsv1.JSONSchemaProps{
+				"clusters.cluster.x-k8s.io":                                      permissive,
+				"awsclusters.infrastructure.cluster.x-k8s.io":                    permissive,
+				"awsclustercontrolleridentities.infrastructure.cluster.x-k8s.io": permissive,
+				"awsclusterroleidentities.infrastructure.cluster.x-k8s.io":       permissive,
+				"awsclusterstaticidentities.infrastructure.cluster.x-k8s.io":     permissive,
+			},
+		},
+		{
+			name: "case 1: changed schema fails",
+			schemas: map[string]*apiextensionsv1.JSONSchemaProps{
+				"clusters.cluster.x-k8s.io":                                      permissive,
+				"awsclusters.infrastructure.cluster.x-k8s.io":                    v1alpha3Status,
+				"awsclustercontrolleridentities.infrastructure.cluster.x-k8s.io": permissive,
+				"awsclusterroleidentities.infrastructure.cluster.x-k8s.io":       permissive,
+				"awsclusterstaticidentities.infrastructure.cluster.x-k8s.io":     permissive,
+			},
+			expectError: true,
+		},
+		{
+			name: "case 2: missing CRD fails",
+			schemas: map[string]*apiextensionsv1.JSONSchemaProps{
+				"clusters.cluster.x-k8s.io":                   permissive,
+				"awsclusters.infrastructure.cluster.x-k8s.io": permissive,
+			},
+			expectError: true,
+		},
+		{
+			name:      "case 3: EKS control plane CRD is checked when EKS is enabled",
+			enableEKS: true,
+			schemas: map[string]*apiextensionsv1.JSONSchemaProps{
+				"clusters.cluster.x-k8s.io":                                      permissive,
+				"awsclusters.infrastructure.cluster.x-k8s.io":                    permissive,
+				"awsclustercontrolleridentities.infrastructure.cluster.x-k8s.io": permissive,
+				"awsclusterroleidentities.infrastructure.cluster.x-k8s.io":       permissive,
+				"awsclusterstaticidentities.infrastructure.cluster.x-k8s.io":     permissive,
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = apiextensionsv1.AddToScheme(scheme)
+
+			var crds []runtime.Object
+			for name, schema := range tc.schemas {
+				crds = append(crds, &apiextensionsv1.CustomResourceDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+						Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+							{Name: key.V1alpha3APIVersion},
+							{Name: v1beta1.ClusterGroupVersion.Version, Schema: &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: schema}},
+						},
+					},
+				})
+			}
+
+			err := checkV1beta1Schemas(context.Background(), fakeclient.NewFakeClientWithScheme(scheme, crds...), tc.enableEKS)
+			if tc.expectError && err == nil {
+				t.Fatal("expected error, got nil")
+			} else if !tc.expectError && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -6,23 +6,31 @@ import (
 
 	clientaws "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/go-logr/logr"
+	eks "sigs.k8s.io/cluster-api-provider-aws/controlplane/eks/api/v1alpha3"
 	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
 	capiutil "sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
 )
 
 type AWSClientConfig struct {
-	ClusterName string
-	CtrlClient  client.Client
-	Log         logr.Logger
+	// CAPANamespace is the namespace of the CAPA controller, secrets of v1beta1 static identities are read from it
+	CAPANamespace string
+	ClusterName   string
+	CtrlClient    client.Client
+	// Endpoints replace the default AWS service endpoints, e.g. to use a stand-in EC2 backend
+	Endpoints []scope.ServiceEndpoint
+	Log       logr.Logger
 }
 
 type AwsClient struct {
-	clusterName string
-	ctrlClient  client.Client
-	log         logr.Logger
+	capaNamespace string
+	clusterName   string
+	ctrlClient    client.Client
+	endpoints     []scope.ServiceEndpoint
+	log           logr.Logger
 }
 
 func New(config AWSClientConfig) (*AwsClient, error) {
@@ -37,9 +45,11 @@ func New(config AWSClientConfig) (*AwsClient, error) {
 	}
 
 	a := &AwsClient{
-		clusterName: config.ClusterName,
-		ctrlClient:  config.CtrlClient,
-		log:         config.Log,
+		capaNamespace: config.CAPANamespace,
+		clusterName:   config.ClusterName,
+		ctrlClient:    config.CtrlClient,
+		endpoints:     config.Endpoints,
+		log:           config.Log,
 	}
 
 	return a, nil
@@ -64,6 +74,7 @@ func (a *AwsClient) GetAWSClientSession(ctx context.Context) (clientaws.ConfigPr
 		Cluster:        cluster,
 		AWSCluster:     awsCluster,
 		ControllerName: "capa-iam",
+		Endpoints:      a.endpoints,
 	})
 	if err != nil {
 		return nil, err
@@ -71,3 +82,42 @@ func (a *AwsClient) GetAWSClientSession(ctx context.Context) (clientaws.ConfigPr
 
 	return clusterScope.Session(), nil
 }
+
+// GetManagedControlPlaneAWSClientSession returns AWS session for the EKS cluster of the AWSManagedControlPlane
+func (a *AwsClient) GetManagedControlPlaneAWSClientSession(ctx context.Context, controlPlane *eks.AWSManagedControlPlane) (clientaws.ConfigProvider, error) {
+	cluster, err := capiutil.GetClusterFromMetadata(ctx, a.ctrlClient, controlPlane.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the control plane scope just to reuse logic of getting proper AWS session from cluster-api-provider-aws controller code
+	controlPlaneScope, err := scope.NewManagedControlPlaneScope(scope.ManagedControlPlaneScopeParams{
+		Client:         a.ctrlClient,
+		Logger:         a.log,
+		Cluster:        cluster,
+		ControlPlane:   controlPlane,
+		ControllerName: "capa-iam",
+		Endpoints:      a.endpoints,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return controlPlaneScope.Session(), nil
+}
+
+// GetV1beta1AWSClientSession returns AWS session for the cluster of the v1beta1 AWSCluster
+func (a *AwsClient) GetV1beta1AWSClientSession(ctx context.Context) (clientaws.ConfigProvider, error) {
+	awsCluster, err := key.GetV1beta1AWSClusterByName(ctx, a.ctrlClient, a.clusterName)
+	if err != nil {
+		a.log.Error(err, "failed to get AWSCluster")
+		return nil, err
+	}
+
+	return a.newSession(ctx, awsCluster.Spec.Region, awsCluster.Namespace, awsCluster.Spec.IdentityRef)
+}
+
+// GetV1beta1ManagedControlPlaneAWSClientSession returns AWS session for the EKS cluster of the v1beta1 AWSManagedControlPlane
+func (a *AwsClient) GetV1beta1ManagedControlPlaneAWSClientSession(ctx context.Context, controlPlane *v1beta1.AWSManagedControlPlane) (clientaws.ConfigProvider, error) {
+	return a.newSession(ctx, controlPlane.Spec.Region, controlPlane.Namespace, controlPlane.Spec.IdentityRef)
+}
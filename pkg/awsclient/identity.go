@@ -0,0 +1,199 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	clientaws "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/identity"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+)
+
+// newSession returns AWS session for the region using the credentials of the v1beta1 identity, the CAPA session
+// code only accepts v1alpha3 clusters so the identity chain is resolved here the same way CAPA does it.
+// Without identity or with the AWSClusterControllerIdentity the credentials of the operator are used.
+func (a *AwsClient) newSession(ctx context.Context, region string, namespace string, identityRef *capa.AWSIdentityReference) (clientaws.ConfigProvider, error) {
+	providers, err := a.identityProviders(ctx, nil, namespace, identityRef)
+	if err != nil {
+		a.log.Error(err, "failed to get identity providers")
+		return nil, err
+	}
+
+	awsConfig := &aws.Config{Region: aws.String(region), EndpointResolver: endpoints.ResolverFunc(a.resolveEndpoint)}
+	if len(providers) > 0 {
+		awsProviders := make([]credentials.Provider, len(providers))
+		for i, p := range providers {
+			awsProviders[i] = p
+		}
+		awsConfig = awsConfig.WithCredentials(credentials.NewChainCredentials(awsProviders))
+	}
+
+	return session.NewSession(awsConfig)
+}
+
+// resolveEndpoint returns the configured endpoint of the service, the same way CAPA resolves them for its sessions
+func (a *AwsClient) resolveEndpoint(service string, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	for _, e := range a.endpoints {
+		if e.ServiceID == service {
+			return endpoints.ResolvedEndpoint{
+				URL:           e.URL,
+				SigningRegion: e.SigningRegion,
+			}, nil
+		}
+	}
+	return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
+}
+
+func (a *AwsClient) identityProviders(ctx context.Context, providers []identity.AWSPrincipalTypeProvider, namespace string, identityRef *capa.AWSIdentityReference) ([]identity.AWSPrincipalTypeProvider, error) {
+	if identityRef == nil {
+		return providers, nil
+	}
+
+	switch identityRef.Kind {
+	case capa.ControllerIdentityKind:
+		if identityRef.Name != capa.AWSClusterControllerIdentityName {
+			return nil, fmt.Errorf("expected %s of name %s, got %s", identityRef.Kind, capa.AWSClusterControllerIdentityName, identityRef.Name)
+		}
+		controllerIdentity := &capa.AWSClusterControllerIdentity{}
+		_, err := a.getIdentity(ctx, identityRef, controllerIdentity)
+		if err != nil {
+			return nil, err
+		}
+		err = a.checkIdentityAllowed(ctx, identityRef, controllerIdentity.Spec.AllowedNamespaces, namespace)
+		if err != nil {
+			return nil, err
+		}
+		// no providers so the credentials of the operator are used
+		return []identity.AWSPrincipalTypeProvider{}, nil
+
+	case capa.ClusterStaticIdentityKind:
+		staticIdentity := &capa.AWSClusterStaticIdentity{}
+		u, err := a.getIdentity(ctx, identityRef, staticIdentity)
+		if err != nil {
+			return nil, err
+		}
+		err = a.checkIdentityAllowed(ctx, identityRef, staticIdentity.Spec.AllowedNamespaces, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		// v1beta1 references the secret only by name, the secret has to be in the namespace of CAPA controller
+		secretName, _, err := unstructured.NestedString(u.Object, "spec", "secretRef")
+		if err != nil {
+			return nil, err
+		}
+		staticIdentity.Spec.SecretRef = corev1.SecretReference{Name: secretName, Namespace: a.capaNamespace}
+
+		secret := &corev1.Secret{}
+		err = a.ctrlClient.Get(ctx, client.ObjectKey{Name: secretName, Namespace: a.capaNamespace}, secret)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, identity.NewAWSStaticPrincipalTypeProvider(staticIdentity, secret))
+
+	case capa.ClusterRoleIdentityKind:
+		roleIdentity := &capa.AWSClusterRoleIdentity{}
+		_, err := a.getIdentity(ctx, identityRef, roleIdentity)
+		if err != nil {
+			return nil, err
+		}
+		err = a.checkIdentityAllowed(ctx, identityRef, roleIdentity.Spec.AllowedNamespaces, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		if roleIdentity.Spec.SourceIdentityRef != nil {
+			providers, err = a.identityProviders(ctx, providers, namespace, roleIdentity.Spec.SourceIdentityRef)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// the last provider is the source of the assumed role
+		if len(providers) > 0 {
+			sourceProvider := providers[len(providers)-1]
+			providers = append(providers[:len(providers)-1], identity.NewAWSRolePrincipalTypeProvider(roleIdentity, &sourceProvider, a.log))
+		} else {
+			providers = append(providers, identity.NewAWSRolePrincipalTypeProvider(roleIdentity, nil, a.log))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown identity kind %s", identityRef.Kind)
+	}
+
+	return providers, nil
+}
+
+// getIdentity fetches the v1beta1 identity and converts it into the v1alpha3 identity, their schemas only differ in
+// the secretRef of the static identity which is skipped here, the fetched identity is returned for reading it
+func (a *AwsClient) getIdentity(ctx context.Context, identityRef *capa.AWSIdentityReference, into interface{}) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(v1beta1.InfrastructureGroupVersion.WithKind(string(identityRef.Kind)))
+
+	err := a.ctrlClient.Get(ctx, client.ObjectKey{Name: identityRef.Name}, u)
+	if err != nil {
+		return nil, err
+	}
+
+	content := u.DeepCopy().UnstructuredContent()
+	unstructured.RemoveNestedField(content, "spec", "secretRef")
+
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content, into)
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// checkIdentityAllowed returns error when clusters in the namespace are not allowed to use the identity,
+// nil allowedNamespaces allows no namespace and empty allowedNamespaces allows all of them
+func (a *AwsClient) checkIdentityAllowed(ctx context.Context, identityRef *capa.AWSIdentityReference, allowedNamespaces *capa.AllowedNamespaces, namespace string) error {
+	notAllowed := fmt.Errorf("%s %s is not allowed to be used in namespace %s", identityRef.Kind, identityRef.Name, namespace)
+
+	if allowedNamespaces == nil {
+		return notAllowed
+	}
+	if reflect.DeepEqual(*allowedNamespaces, capa.AllowedNamespaces{}) {
+		return nil
+	}
+	for _, n := range allowedNamespaces.NamespaceList {
+		if n == namespace {
+			return nil
+		}
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&allowedNamespaces.Selector)
+	if err != nil {
+		return err
+	}
+	// empty selector matches no namespace
+	if selector.Empty() {
+		return notAllowed
+	}
+
+	var namespaces corev1.NamespaceList
+	err = a.ctrlClient.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return err
+	}
+	for _, n := range namespaces.Items {
+		if n.Name == namespace {
+			return nil
+		}
+	}
+
+	return notAllowed
+}
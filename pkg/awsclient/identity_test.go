@@ -0,0 +1,213 @@
+package awsclient
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/identity"
+	"sigs.k8s.io/cluster-api-provider-aws/pkg/cloud/scope"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+)
+
+const (
+	capaNamespace    = "capa-system"
+	clusterNamespace = "org-test"
+)
+
+func Test_IdentityProviders(t *testing.T) {
+	allowAll := map[string]interface{}{}
+
+	testCases := []struct {
+		name        string
+		identityRef *capa.AWSIdentityReference
+		identities  []runtime.Object
+		// expectedProviders are the names of the principals of the providers
+		expectedProviders []string
+		expectError       bool
+	}{
+		{
+			name: "case 0: no identity uses the operator credentials",
+		},
+		{
+			name:        "case 1: controller identity uses the operator credentials",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ControllerIdentityKind, Name: capa.AWSClusterControllerIdentityName},
+			identities: []runtime.Object{
+				newIdentity(capa.ControllerIdentityKind, capa.AWSClusterControllerIdentityName, map[string]interface{}{"allowedNamespaces": allowAll}),
+			},
+		},
+		{
+			name:        "case 2: static identity reads the secret from the CAPA namespace",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterStaticIdentityKind, Name: "static"},
+			identities: []runtime.Object{
+				newIdentity(capa.ClusterStaticIdentityKind, "static", map[string]interface{}{"allowedNamespaces": allowAll, "secretRef": "static-credentials"}),
+			},
+			expectedProviders: []string{"static"},
+		},
+		{
+			name:        "case 3: role identity assumes the role with its source identity",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterRoleIdentityKind, Name: "role"},
+			identities: []runtime.Object{
+				newIdentity(capa.ClusterRoleIdentityKind, "role", map[string]interface{}{
+					"allowedNamespaces": allowAll,
+					"roleARN":           "arn:aws:iam::123456789012:role/test",
+					"sourceIdentityRef": map[string]interface{}{"kind": string(capa.ClusterStaticIdentityKind), "name": "static"},
+				}),
+				newIdentity(capa.ClusterStaticIdentityKind, "static", map[string]interface{}{"allowedNamespaces": allowAll, "secretRef": "static-credentials"}),
+			},
+			expectedProviders: []string{"role"},
+		},
+		{
+			name:        "case 4: identity without allowed namespaces is rejected",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterRoleIdentityKind, Name: "role"},
+			identities: []runtime.Object{
+				newIdentity(capa.ClusterRoleIdentityKind, "role", map[string]interface{}{"roleARN": "arn:aws:iam::123456789012:role/test"}),
+			},
+			expectError: true,
+		},
+		{
+			name:        "case 5: identity allowed for other namespaces is rejected",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterRoleIdentityKind, Name: "role"},
+			identities: []runtime.Object{
+				newIdentity(capa.ClusterRoleIdentityKind, "role", map[string]interface{}{
+					"allowedNamespaces": map[string]interface{}{"list": []interface{}{"org-other"}},
+					"roleARN":           "arn:aws:iam::123456789012:role/test",
+				}),
+			},
+			expectError: true,
+		},
+		{
+			name:        "case 6: identity allowed via namespace selector",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterRoleIdentityKind, Name: "role"},
+			identities: []runtime.Object{
+				newIdentity(capa.ClusterRoleIdentityKind, "role", map[string]interface{}{
+					"allowedNamespaces": map[string]interface{}{"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"org": "test"}}},
+					"roleARN":           "arn:aws:iam::123456789012:role/test",
+				}),
+			},
+			expectedProviders: []string{"role"},
+		},
+		{
+			name:        "case 7: missing identity fails",
+			identityRef: &capa.AWSIdentityReference{Kind: capa.ClusterRoleIdentityKind, Name: "role"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			objs := append([]runtime.Object{
+				&corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: clusterNamespace, Labels: map[string]string{"org": "test"}},
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "static-credentials", Namespace: capaNamespace},
+					Data: map[string][]byte{
+						"AccessKeyID":     []byte("key"),
+						"SecretAccessKey": []byte("secret"),
+					},
+				},
+			}, tc.identities...)
+
+			a, err := New(AWSClientConfig{
+				CAPANamespace: capaNamespace,
+				ClusterName:   "test",
+				CtrlClient:    fakeclient.NewFakeClientWithScheme(scheme, objs...),
+				Log:           ctrllog.NullLogger{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			providers, err := a.identityProviders(context.Background(), nil, clusterNamespace, tc.identityRef)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got %d providers", len(providers))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(providers) != len(tc.expectedProviders) {
+				t.Fatalf("expected %d providers, got %d", len(tc.expectedProviders), len(providers))
+			}
+			for i, p := range providers {
+				if p.Name() != tc.expectedProviders[i] {
+					t.Fatalf("expected provider %s, got %s", tc.expectedProviders[i], p.Name())
+				}
+				if static, ok := p.(*identity.AWSStaticPrincipalTypeProvider); ok && static.Principal.Spec.SecretRef.Namespace != capaNamespace {
+					t.Fatalf("expected secret namespace %s, got %s", capaNamespace, static.Principal.Spec.SecretRef.Namespace)
+				}
+			}
+		})
+	}
+}
+
+func newIdentity(kind capa.AWSIdentityKind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetGroupVersionKind(v1beta1.InfrastructureGroupVersion.WithKind(string(kind)))
+	u.SetName(name)
+	return u
+}
+
+func Test_NewSessionEndpoints(t *testing.T) {
+	testCases := []struct {
+		name             string
+		endpoints        []scope.ServiceEndpoint
+		expectedEndpoint string
+	}{
+		{
+			name:             "case 0: default endpoint",
+			expectedEndpoint: "https://ec2.eu-west-1.amazonaws.com",
+		},
+		{
+			name:             "case 1: configured endpoint",
+			endpoints:        []scope.ServiceEndpoint{{ServiceID: "ec2", URL: "http://127.0.0.1:8080", SigningRegion: "eu-west-1"}},
+			expectedEndpoint: "http://127.0.0.1:8080",
+		},
+		{
+			name:             "case 2: endpoint of other service",
+			endpoints:        []scope.ServiceEndpoint{{ServiceID: "elasticloadbalancing", URL: "http://127.0.0.1:8080", SigningRegion: "eu-west-1"}},
+			expectedEndpoint: "https://ec2.eu-west-1.amazonaws.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			a, err := New(AWSClientConfig{
+				ClusterName: "test",
+				CtrlClient:  fakeclient.NewFakeClientWithScheme(scheme),
+				Endpoints:   tc.endpoints,
+				Log:         ctrllog.NullLogger{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := a.newSession(context.Background(), "eu-west-1", clusterNamespace, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoint := s.ClientConfig("ec2").Endpoint
+			if endpoint != tc.expectedEndpoint {
+				t.Fatalf("expected endpoint %s, got %s", tc.expectedEndpoint, endpoint)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package cidr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/giantswarm/ipam"
+	"github.com/go-logr/logr"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	eks "sigs.k8s.io/cluster-api-provider-aws/controlplane/eks/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/metrics"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+)
+
+// allocationLock serializes allocations of all allocators in the process, the AWSCluster and AWSManagedControlPlane
+// reconcilers allocate from the same pool and a CIDR has to be saved before the next allocation reads the reserved ones
+var allocationLock sync.Mutex
+
+// Object is the cluster object the allocated CNI CIDR is saved on
+type Object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// EC2API is the subset of the EC2 API used by the allocator
+type EC2API interface {
+	DescribeVpcs(*ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error)
+}
+
+type AllocatorConfig struct {
+	// APIVersion is the served version of the Cluster API and CAPA APIs, v1alpha3 is used when empty
+	APIVersion string
+	// APIReader reads allocations of other clusters from the API server, the cache might not contain the latest ones yet
+	APIReader  client.Reader
+	AWSSession awsclient.ConfigProvider
+	CtrlClient client.Client
+	// EC2Client is used instead of the client created from AWSSession when set
+	EC2Client   EC2API
+	DefaultCIDR string
+	Log         logr.Logger
+	Pool        string
+	MaskSize    int
+	// EKSEnabled makes the allocator reserve CNI CIDRs of AWSManagedControlPlanes as well, the CRD must be installed
+	EKSEnabled bool
+}
+
+type Allocator struct {
+	apiVersion  string
+	apiReader   client.Reader
+	ec2Client   EC2API
+	ctrlClient  client.Client
+	defaultCIDR string
+	eksEnabled  bool
+	log         logr.Logger
+	pool        net.IPNet
+	mask        net.IPMask
+}
+
+func New(c AllocatorConfig) (*Allocator, error) {
+	if c.AWSSession == nil && c.EC2Client == nil {
+		return nil, errors.New("failed to generate new cidr allocator from nil AWSSession and EC2Client")
+	}
+
+	if c.CtrlClient == nil {
+		return nil, errors.New("failed to generate new cidr allocator from nil CtrlClient")
+	}
+
+	if c.APIReader == nil {
+		return nil, errors.New("failed to generate new cidr allocator from nil APIReader")
+	}
+
+	if c.Log == nil {
+		return nil, errors.New("failed to generate new cidr allocator from nil logger")
+	}
+
+	_, pool, err := net.ParseCIDR(c.Pool)
+	if err != nil {
+		return nil, err
+	}
+
+	poolMaskSize, bits := pool.Mask.Size()
+	if c.MaskSize < poolMaskSize || c.MaskSize > bits {
+		return nil, fmt.Errorf("failed to generate new cidr allocator, mask size /%d does not fit into pool %s", c.MaskSize, pool.String())
+	}
+
+	ec2Client := c.EC2Client
+	if ec2Client == nil {
+		awsEC2Client := ec2.New(c.AWSSession)
+		metrics.InstrumentAWSClient(awsEC2Client.Client)
+		ec2Client = awsEC2Client
+	}
+
+	a := &Allocator{
+		apiVersion:  c.APIVersion,
+		apiReader:   c.APIReader,
+		ec2Client:   ec2Client,
+		ctrlClient:  c.CtrlClient,
+		defaultCIDR: c.DefaultCIDR,
+		eksEnabled:  c.EKSEnabled,
+		log:         c.Log,
+		pool:        *pool,
+		mask:        net.CIDRMask(c.MaskSize, bits),
+	}
+	return a, nil
+}
+
+// Allocate will pick a CNI CIDR from the pool for the cluster of the object which does not overlap
+// with any CIDR already associated with the cluster VPC or allocated for other clusters, the CIDR is saved
+// in the CNI CIDR annotation of the object before another allocation can start
+func (a *Allocator) Allocate(ctx context.Context, obj Object, vpcID string) (string, error) {
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	vpcCIDRs, err := a.vpcCIDRBlocks(vpcID)
+	if err != nil {
+		return "", err
+	}
+
+	cidr := ""
+	// clusters created before the pool was configured already use the default CNI CIDR, keep it
+	for _, c := range vpcCIDRs {
+		if a.defaultCIDR != "" && c == a.defaultCIDR {
+			a.log.Info(fmt.Sprintf("default CNI CIDR %s is already associated with vpc, keeping it", a.defaultCIDR))
+			cidr = a.defaultCIDR
+			break
+		}
+	}
+
+	if cidr == "" {
+		cidr, err = a.allocate(ctx, obj, vpcCIDRs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = a.save(ctx, obj, key.CNICIDRAnnotation, cidr)
+	if err != nil {
+		return "", err
+	}
+	return cidr, nil
+}
+
+// AllocateAdditional will pick another CNI CIDR from the pool for the cluster of the object to expand its CNI capacity,
+// the CIDR is appended to the additional CNI CIDRs annotation of the object before another allocation can start
+func (a *Allocator) AllocateAdditional(ctx context.Context, obj Object, vpcID string) (string, error) {
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	vpcCIDRs, err := a.vpcCIDRBlocks(vpcID)
+	if err != nil {
+		return "", err
+	}
+
+	cidr, err := a.allocate(ctx, obj, vpcCIDRs)
+	if err != nil {
+		return "", err
+	}
+
+	additionalCIDRs := append(key.GetAdditionalCNICIDRsFromAnnotations(obj), cidr)
+	err = a.save(ctx, obj, key.CNIAdditionalCIDRsAnnotation, strings.Join(additionalCIDRs, ","))
+	if err != nil {
+		return "", err
+	}
+	return cidr, nil
+}
+
+// save persists the allocation in the annotation of the object so it stays stable across reconciliations
+func (a *Allocator) save(ctx context.Context, obj Object, annotation string, value string) error {
+	objPatch := client.MergeFrom(obj.DeepCopyObject())
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annotation] = value
+	obj.SetAnnotations(annotations)
+
+	err := a.ctrlClient.Patch(ctx, obj, objPatch)
+	if err != nil {
+		a.log.Error(err, fmt.Sprintf("failed to save allocated CNI CIDR in annotation %s", annotation))
+		return err
+	}
+	return nil
+}
+
+func (a *Allocator) allocate(ctx context.Context, obj Object, vpcCIDRs []string) (string, error) {
+	clusterCIDRs, err := a.clusterCIDRs(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+
+	var reserved []net.IPNet
+	for _, c := range append(vpcCIDRs, clusterCIDRs...) {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			a.log.Error(err, fmt.Sprintf("failed to parse reserved cidr %s, ignoring it", c))
+			continue
+		}
+
+		reservedOnes, _ := n.Mask.Size()
+		poolOnes, _ := a.pool.Mask.Size()
+		if reservedOnes <= poolOnes && n.Contains(a.pool.IP) {
+			// reserved range covers the whole pool
+			return "", fmt.Errorf("cidr pool %s is fully covered by reserved range %s", a.pool.String(), n.String())
+		} else if a.pool.Contains(n.IP) {
+			reserved = append(reserved, *n)
+		}
+	}
+
+	free, err := ipam.Free(a.pool, a.mask, reserved)
+	if err != nil {
+		a.log.Error(err, fmt.Sprintf("failed to find free cidr in pool %s", a.pool.String()))
+		return "", err
+	}
+
+	a.log.Info(fmt.Sprintf("allocated CNI CIDR %s from pool %s", free.String(), a.pool.String()))
+	return free.String(), nil
+}
+
+// vpcCIDRBlocks returns all cidr blocks associated with the vpc
+func (a *Allocator) vpcCIDRBlocks(vpcID string) ([]string, error) {
+	o, err := a.ec2Client.DescribeVpcs(&ec2.DescribeVpcsInput{VpcIds: aws.StringSlice([]string{vpcID})})
+	if err != nil {
+		a.log.Error(err, "failed to describe VPC")
+		return nil, err
+	}
+
+	var cidrs []string
+	for _, v := range o.Vpcs {
+		for _, b := range v.CidrBlockAssociationSet {
+			cidrs = append(cidrs, aws.StringValue(b.CidrBlock))
+		}
+	}
+	return cidrs, nil
+}
+
+// clusterCIDRs returns CNI CIDRs used by all other clusters, set either in their AWSCNIConfig or on their AWSCluster
+// or AWSManagedControlPlane, they are read from the API server as allocations saved just now might not be cached yet
+func (a *Allocator) clusterCIDRs(ctx context.Context, obj Object) ([]string, error) {
+	awsCNIConfigList := &v1alpha1.AWSCNIConfigList{}
+	if err := a.apiReader.List(ctx, awsCNIConfigList); err != nil {
+		a.log.Error(err, "failed to list AWSCNIConfigs")
+		return nil, err
+	}
+
+	self := types.NamespacedName{Namespace: obj.GetNamespace(), Name: key.GetClusterIDFromLabels(obj)}
+	configCIDRs := map[types.NamespacedName]string{}
+	var cidrs []string
+	for i := range awsCNIConfigList.Items {
+		c := &awsCNIConfigList.Items[i]
+		name := types.NamespacedName{Namespace: c.Namespace, Name: key.GetClusterIDFromLabels(c)}
+		if c.Spec.CIDR == "" || name == self {
+			continue
+		}
+		// CIDR set in AWSCNIConfig is not persisted on the cluster object
+		configCIDRs[name] = c.Spec.CIDR
+		cidrs = append(cidrs, c.Spec.CIDR)
+	}
+
+	var clusterObjects []metav1.Object
+	for _, list := range a.clusterLists() {
+		if err := a.apiReader.List(ctx, list); err != nil {
+			a.log.Error(err, fmt.Sprintf("failed to list %T", list))
+			return nil, err
+		}
+		items, err := apimeta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			c, err := apimeta.Accessor(item)
+			if err != nil {
+				return nil, err
+			}
+			clusterObjects = append(clusterObjects, c)
+		}
+	}
+
+	for _, c := range clusterObjects {
+		name := types.NamespacedName{Namespace: c.GetNamespace(), Name: key.GetClusterIDFromLabels(c)}
+		if name == self {
+			continue
+		}
+
+		// AWSCNIConfig takes precedence over the annotation
+		_, hasConfigCIDR := configCIDRs[name]
+		if hasConfigCIDR {
+			// already reserved
+		} else if cidr := key.GetCNICIDRFromAnnotations(c); cidr != "" {
+			cidrs = append(cidrs, cidr)
+		} else if a.defaultCIDR != "" {
+			// cluster without annotation is using the default CNI CIDR
+			cidrs = append(cidrs, a.defaultCIDR)
+		}
+		cidrs = append(cidrs, key.GetAdditionalCNICIDRsFromAnnotations(c)...)
+	}
+	return cidrs, nil
+}
+
+// clusterLists returns lists of the objects which carry CNI CIDRs of clusters in the served API version
+func (a *Allocator) clusterLists() []runtime.Object {
+	if a.apiVersion == key.V1beta1APIVersion {
+		lists := []runtime.Object{&v1beta1.AWSClusterList{}}
+		if a.eksEnabled {
+			lists = append(lists, &v1beta1.AWSManagedControlPlaneList{})
+		}
+		return lists
+	}
+
+	lists := []runtime.Object{&capa.AWSClusterList{}}
+	if a.eksEnabled {
+		lists = append(lists, &eks.AWSManagedControlPlaneList{})
+	}
+	return lists
+}
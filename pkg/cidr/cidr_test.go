@@ -0,0 +1,326 @@
+package cidr
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	eks "sigs.k8s.io/cluster-api-provider-aws/controlplane/eks/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni/fake"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
+)
+
+func Test_Allocate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		apiVersion string
+		pool       string
+		// existing are the CNI CIDR annotations of other AWSClusters, empty value means no annotation
+		existing []string
+		// configCIDRs are CIDRs of other clusters set only in their AWSCNIConfig
+		configCIDRs []string
+		// controlPlaneCIDRs are the CNI CIDR annotations of AWSManagedControlPlanes of EKS clusters
+		controlPlaneCIDRs []string
+		vpcCIDRs          []string
+		expectedCIDR      string
+		expectError       bool
+	}{
+		{
+			name:         "case 0: first cluster gets the first range of the pool",
+			pool:         "100.64.0.0/10",
+			vpcCIDRs:     []string{"10.0.0.0/16"},
+			expectedCIDR: "100.64.0.0/16",
+		},
+		{
+			name:         "case 1: second cluster gets the next range",
+			pool:         "100.64.0.0/10",
+			existing:     []string{"100.64.0.0/16"},
+			vpcCIDRs:     []string{"10.0.0.0/16"},
+			expectedCIDR: "100.65.0.0/16",
+		},
+		{
+			name:         "case 2: allocations of several clusters are skipped",
+			pool:         "100.64.0.0/10",
+			existing:     []string{"100.64.0.0/16", "100.65.0.0/16", "100.67.0.0/16"},
+			vpcCIDRs:     []string{"10.0.0.0/16"},
+			expectedCIDR: "100.66.0.0/16",
+		},
+		{
+			name:         "case 3: cluster without annotation reserves the default CIDR",
+			pool:         "100.64.0.0/10",
+			existing:     []string{""},
+			vpcCIDRs:     []string{"10.0.0.0/16"},
+			expectedCIDR: "100.65.0.0/16",
+		},
+		{
+			name:         "case 4: CIDRs set in AWSCNIConfig are reserved",
+			pool:         "100.64.0.0/10",
+			existing:     []string{"100.64.0.0/16"},
+			configCIDRs:  []string{"100.65.0.0/16"},
+			vpcCIDRs:     []string{"10.0.0.0/16"},
+			expectedCIDR: "100.66.0.0/16",
+		},
+		{
+			name:         "case 5: CIDRs associated with the vpc are reserved",
+			pool:         "100.64.0.0/10",
+			existing:     []string{"100.64.0.0/16"},
+			vpcCIDRs:     []string{"10.0.0.0/16", "100.65.0.0/16"},
+			expectedCIDR: "100.66.0.0/16",
+		},
+		{
+			name:              "case 6: CIDRs of EKS clusters are reserved",
+			pool:              "100.64.0.0/10",
+			existing:          []string{"100.64.0.0/16"},
+			controlPlaneCIDRs: []string{"100.65.0.0/16"},
+			vpcCIDRs:          []string{"10.0.0.0/16"},
+			expectedCIDR:      "100.66.0.0/16",
+		},
+		{
+			name:              "case 7: CIDRs of v1beta1 clusters are reserved",
+			apiVersion:        key.V1beta1APIVersion,
+			pool:              "100.64.0.0/10",
+			existing:          []string{"100.65.0.0/16", ""},
+			controlPlaneCIDRs: []string{"100.66.0.0/16"},
+			vpcCIDRs:          []string{"10.0.0.0/16"},
+			expectedCIDR:      "100.67.0.0/16",
+		},
+		{
+			name:        "case 8: vpc CIDR covering the whole pool fails",
+			pool:        "100.64.0.0/16",
+			vpcCIDRs:    []string{"100.64.0.0/10"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			scheme := runtime.NewScheme()
+			_ = capa.AddToScheme(scheme)
+			_ = eks.AddToScheme(scheme)
+			_ = v1alpha1.AddToScheme(scheme)
+			_ = v1beta1.AddToScheme(scheme)
+
+			var objs []runtime.Object
+			for i, cidr := range tc.existing {
+				meta := metav1.ObjectMeta{
+					Name:      clusterName(i),
+					Namespace: "default",
+					Labels:    map[string]string{key.ClusterNameLabel: clusterName(i)},
+				}
+				if cidr != "" {
+					meta.Annotations = map[string]string{key.CNICIDRAnnotation: cidr}
+				}
+				if tc.apiVersion == key.V1beta1APIVersion {
+					objs = append(objs, &v1beta1.AWSCluster{ObjectMeta: meta})
+				} else {
+					objs = append(objs, &capa.AWSCluster{ObjectMeta: meta})
+				}
+			}
+			for i, cidr := range tc.configCIDRs {
+				objs = append(objs, &v1alpha1.AWSCNIConfig{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      clusterName(len(tc.existing) + i),
+						Namespace: "default",
+						Labels:    map[string]string{key.ClusterNameLabel: clusterName(len(tc.existing) + i)},
+					},
+					Spec: v1alpha1.AWSCNIConfigSpec{CIDR: cidr},
+				})
+			}
+			for i, cidr := range tc.controlPlaneCIDRs {
+				name := clusterName(len(tc.existing) + len(tc.configCIDRs) + i)
+				meta := metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   "default",
+					Labels:      map[string]string{key.ClusterNameLabel: name},
+					Annotations: map[string]string{key.CNICIDRAnnotation: cidr},
+				}
+				if tc.apiVersion == key.V1beta1APIVersion {
+					objs = append(objs, &v1beta1.AWSManagedControlPlane{ObjectMeta: meta})
+				} else {
+					objs = append(objs, &eks.AWSManagedControlPlane{ObjectMeta: meta})
+				}
+			}
+
+			ec2Client := fake.NewEC2()
+			vpcID := ec2Client.AddVPC(tc.vpcCIDRs[0])
+			for _, c := range tc.vpcCIDRs[1:] {
+				_, err := ec2Client.AssociateVpcCidrBlock(&ec2.AssociateVpcCidrBlockInput{VpcId: aws.String(vpcID), CidrBlock: aws.String(c)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctrlClient := fakeclient.NewFakeClientWithScheme(scheme, objs...)
+			allocator, err := New(AllocatorConfig{
+				APIVersion:  tc.apiVersion,
+				APIReader:   ctrlClient,
+				CtrlClient:  ctrlClient,
+				EC2Client:   ec2Client,
+				DefaultCIDR: "100.64.0.0/16",
+				EKSEnabled:  true,
+				Log:         zap.New(),
+				Pool:        tc.pool,
+				MaskSize:    16,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			awsCluster := &capa.AWSCluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "new",
+					Namespace: "default",
+					Labels:    map[string]string{key.ClusterNameLabel: "new"},
+				},
+			}
+			err = ctrlClient.Create(ctx, awsCluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cidr, err := allocator.Allocate(ctx, awsCluster, vpcID)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got cidr %s", cidr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cidr != tc.expectedCIDR {
+				t.Fatalf("expected cidr %s, got %s", tc.expectedCIDR, cidr)
+			}
+
+			// allocated CIDR is saved on the cluster
+			saved := &capa.AWSCluster{}
+			err = ctrlClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "new"}, saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.GetCNICIDRFromAnnotations(saved) != tc.expectedCIDR {
+				t.Fatalf("expected saved cidr %s, got %s", tc.expectedCIDR, key.GetCNICIDRFromAnnotations(saved))
+			}
+		})
+	}
+}
+
+// staleClient is a client with a cache which has not seen any cluster yet
+type staleClient struct {
+	client.Client
+}
+
+func (c staleClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	return nil
+}
+
+func Test_AllocateBackToBack(t *testing.T) {
+	testCases := []struct {
+		name string
+		// concurrent allocates for all clusters at the same time instead of one after another
+		concurrent bool
+	}{
+		{
+			name: "case 0: clusters allocating one after another get different CIDRs",
+		},
+		{
+			name:       "case 1: clusters allocating at the same time get different CIDRs",
+			concurrent: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			scheme := runtime.NewScheme()
+			_ = capa.AddToScheme(scheme)
+			_ = eks.AddToScheme(scheme)
+			_ = v1alpha1.AddToScheme(scheme)
+
+			var clusters []runtime.Object
+			for i := 0; i < 4; i++ {
+				clusters = append(clusters, &capa.AWSCluster{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      clusterName(i),
+						Namespace: "default",
+						Labels:    map[string]string{key.ClusterNameLabel: clusterName(i)},
+					},
+				})
+			}
+			// EKS clusters allocate from the same pool as well
+			clusters = append(clusters, &eks.AWSManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      clusterName(len(clusters)),
+					Namespace: "default",
+					Labels:    map[string]string{key.ClusterNameLabel: clusterName(len(clusters))},
+				},
+			})
+			apiServer := fakeclient.NewFakeClientWithScheme(scheme, clusters...)
+
+			ec2Client := fake.NewEC2()
+			vpcID := ec2Client.AddVPC("10.0.0.0/16")
+
+			allocate := func(obj Object) (string, error) {
+				allocator, err := New(AllocatorConfig{
+					APIReader:   apiServer,
+					CtrlClient:  staleClient{Client: apiServer},
+					EC2Client:   ec2Client,
+					DefaultCIDR: "100.64.0.0/16",
+					EKSEnabled:  true,
+					Log:         zap.New(),
+					Pool:        "100.64.0.0/10",
+					MaskSize:    16,
+				})
+				if err != nil {
+					return "", err
+				}
+				return allocator.Allocate(ctx, obj, vpcID)
+			}
+
+			cidrs := make([]string, len(clusters))
+			errs := make([]error, len(clusters))
+			var wg sync.WaitGroup
+			for i, c := range clusters {
+				if tc.concurrent {
+					wg.Add(1)
+					go func(i int, obj Object) {
+						defer wg.Done()
+						cidrs[i], errs[i] = allocate(obj)
+					}(i, c.(Object))
+				} else {
+					cidrs[i], errs[i] = allocate(c.(Object))
+				}
+			}
+			wg.Wait()
+
+			allocated := map[string]string{}
+			for i, c := range cidrs {
+				if errs[i] != nil {
+					t.Fatal(errs[i])
+				}
+				if other, ok := allocated[c]; ok {
+					t.Fatalf("expected different cidrs, got %s for %s and %s", c, other, clusterName(i))
+				}
+				allocated[c] = clusterName(i)
+			}
+		})
+	}
+}
+
+func clusterName(i int) string {
+	return string(rune('a'+i)) + "-cluster"
+}
@@ -5,9 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	awsclient "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/giantswarm/ipam"
@@ -15,42 +20,111 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/metrics"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/record"
+)
+
+const (
+	eniConfigDeletionTimeout = 30 * time.Second
+	// eniConfigDocsAnnotation is set on all ENIConfigs created by the operator, including those created before
+	// they were labeled
+	eniConfigDocsAnnotation = "giantswarm.io/docs"
+	eniConfigDocsURL        = "https://godoc.org/github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1#ENIConfig"
 )
 
 type CNISubnet struct {
-	AZ       string
+	// Active is true for subnets of the newest CNI CIDR which are referenced by ENIConfigs
+	Active       bool
+	AZ           string
+	AvailableIPs int64
+	CIDRBlock    string
+	// Draining is true for subnets of AZs removed from the cluster, they are deleted once their network interfaces are detached
+	Draining bool
 	SubnetID string
 }
 
+// UsedIPsPercentage returns percentage of used IP addresses in the subnet, AWS reserved addresses are not counted
+func (s CNISubnet) UsedIPsPercentage() float64 {
+	_, n, err := net.ParseCIDR(s.CIDRBlock)
+	if err != nil {
+		return 0
+	}
+	ones, bits := n.Mask.Size()
+	usable := int64(1)<<uint(bits-ones) - 5
+	if usable <= 0 {
+		return 100
+	}
+	return float64(usable-s.AvailableIPs) * 100 / float64(usable)
+}
+
+// ExistingSubnet selects a pre-existing subnet of the AZ by ID or, when ID is empty, by tags
+type ExistingSubnet struct {
+	AZ   string
+	ID   string
+	Tags map[string]string
+}
+
 type CNIConfig struct {
-	AWSSession         awsclient.ConfigProvider
-	ClusterName        string
-	CNISecurityGroupID string
-	CtrlClient         client.Client
-	CNICIDR            string
-	Log                logr.Logger
-	VPCAzList          []string
-	VPCID              string
+	// AdditionalCNICIDRs are CIDRs added to the VPC when CNICIDR ran out of free IPs, the last one is used for ENIConfigs
+	AdditionalCNICIDRs         []string
+	AdditionalSecurityGroupIDs []string
+	AdditionalTags             map[string]string
+	AWSSession                 awsclient.ConfigProvider
+	ClusterName                string
+	// ClusterTags are the AdditionalTags of the AWSCluster, AdditionalTags take precedence over them
+	ClusterTags          map[string]string
+	CNISecurityGroupID   string
+	CtrlClient           client.Client
+	CNICIDR              string
+	ENIConfigAnnotations map[string]string
+	ENIConfigLabels      map[string]string
+	// EC2Client is used instead of a client created from AWSSession when set
+	EC2Client EC2API
+	// EventObject is the object on which kubernetes events are recorded, e.g. the AWSCluster
+	EventObject runtime.Object
+	// ExistingSubnets are used for ENIConfigs instead of creating CNI subnets, no AWS resources are changed when set
+	ExistingSubnets []ExistingSubnet
+	// LastAppliedTags are the additional tags applied to the CNI subnets before, those which are not desired anymore are removed
+	LastAppliedTags map[string]string
+	Log             logr.Logger
+	RouteTableIDs   map[string]string
+	// SubnetMaskSize is the size of each CNI subnet, 0 means CNICIDR is split evenly between AZs
+	SubnetMaskSize int
+	VPCAzList      []string
+	VPCID          string
 }
 
 type CNIService struct {
-	awsSession         awsclient.ConfigProvider
-	clusterName        string
-	cniSecurityGroupID string
-	ctrlClient         client.Client
-	cniCIDR            string
-	log                logr.Logger
-	vpcAzList          []string
-	vpcID              string
+	additionalCNICIDRs         []string
+	additionalSecurityGroupIDs []string
+	additionalTags             map[string]string
+	clusterName                string
+	clusterTags                map[string]string
+	cniSecurityGroupID         string
+	ctrlClient                 client.Client
+	cniCIDR                    string
+	ec2Client                  EC2API
+	eniConfigAnnotations       map[string]string
+	eniConfigLabels            map[string]string
+	eventObject                runtime.Object
+	existingSubnets            []ExistingSubnet
+	lastAppliedTags            map[string]string
+	log                        logr.Logger
+	routeTableIDs              map[string]string
+	subnetMaskSize             int
+	vpcAzList                  []string
+	vpcID                      string
 }
 
 func New(c CNIConfig) (*CNIService, error) {
-	if c.AWSSession == nil {
-		return nil, errors.New("failed to generate new cni service from nil AWSSession")
+	if c.AWSSession == nil && c.EC2Client == nil {
+		return nil, errors.New("failed to generate new cni service from nil AWSSession and EC2Client")
 	}
 
 	if c.ClusterName == "" {
@@ -61,11 +135,43 @@ func New(c CNIConfig) (*CNIService, error) {
 		return nil, errors.New("failed to generate new cni service from empty CNISecurityGroupID")
 	}
 
-	_, _, err := net.ParseCIDR(c.CNICIDR)
+	_, cniNetwork, err := net.ParseCIDR(c.CNICIDR)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, cidr := range c.AdditionalCNICIDRs {
+		_, additionalNetwork, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if ones, _ := additionalNetwork.Mask.Size(); c.SubnetMaskSize != 0 && c.SubnetMaskSize < ones {
+			return nil, fmt.Errorf("failed to generate new cni service, subnet mask size /%d does not fit into AdditionalCNICIDR %s", c.SubnetMaskSize, cidr)
+		}
+	}
+
+	if c.SubnetMaskSize != 0 {
+		ones, bits := cniNetwork.Mask.Size()
+		if c.SubnetMaskSize < ones || c.SubnetMaskSize > bits {
+			return nil, fmt.Errorf("failed to generate new cni service, subnet mask size /%d does not fit into CNICIDR %s", c.SubnetMaskSize, c.CNICIDR)
+		}
+	}
+
+	if c.EventObject == nil {
+		return nil, errors.New("failed to generate new cni service from nil EventObject")
+	}
+
+	existingAZs := map[string]bool{}
+	for _, e := range c.ExistingSubnets {
+		if e.ID == "" && len(e.Tags) == 0 {
+			return nil, fmt.Errorf("failed to generate new cni service, existing subnet of AZ %s has neither ID nor tags", e.AZ)
+		}
+		if existingAZs[e.AZ] {
+			return nil, fmt.Errorf("failed to generate new cni service, AZ %s has more than one existing subnet", e.AZ)
+		}
+		existingAZs[e.AZ] = true
+	}
+
 	if c.Log == nil {
 		return nil, errors.New("failed to generate new cni service from nil logger")
 	}
@@ -78,45 +184,198 @@ func New(c CNIConfig) (*CNIService, error) {
 		return nil, errors.New("failed to generate new cni service from empty VPCID")
 	}
 
+	ec2Client := c.EC2Client
+	if ec2Client == nil {
+		awsEC2Client := ec2.New(c.AWSSession)
+		metrics.InstrumentAWSClient(awsEC2Client.Client)
+		ec2Client = awsEC2Client
+	}
+
 	s := &CNIService{
-		awsSession:         c.AWSSession,
-		clusterName:        c.ClusterName,
-		cniSecurityGroupID: c.CNISecurityGroupID,
-		ctrlClient:         c.CtrlClient,
-		cniCIDR:            c.CNICIDR,
-		log:                c.Log,
-		vpcAzList:          c.VPCAzList,
-		vpcID:              c.VPCID,
+		additionalCNICIDRs:         c.AdditionalCNICIDRs,
+		additionalSecurityGroupIDs: c.AdditionalSecurityGroupIDs,
+		additionalTags:             c.AdditionalTags,
+		clusterName:                c.ClusterName,
+		clusterTags:                c.ClusterTags,
+		cniSecurityGroupID:         c.CNISecurityGroupID,
+		ctrlClient:                 c.CtrlClient,
+		cniCIDR:                    c.CNICIDR,
+		ec2Client:                  ec2Client,
+		eniConfigAnnotations:       c.ENIConfigAnnotations,
+		eniConfigLabels:            c.ENIConfigLabels,
+		eventObject:                c.EventObject,
+		existingSubnets:            c.ExistingSubnets,
+		lastAppliedTags:            c.LastAppliedTags,
+		log:                        c.Log,
+		routeTableIDs:              c.RouteTableIDs,
+		subnetMaskSize:             c.SubnetMaskSize,
+		vpcAzList:                  c.VPCAzList,
+		vpcID:                      c.VPCID,
 	}
 	return s, nil
 }
 
-func (c *CNIService) Reconcile() error {
-	ec2Client := ec2.New(c.awsSession)
+// Reconcile will create all CNI resources and return the CNI subnets of the cluster
+func (c *CNIService) Reconcile() ([]CNISubnet, error) {
+	ec2Client := c.ec2Client
 
-	// associate CNI  CIDR to the cluster VPC
-	err := c.associateVPCCidrBlock(ec2Client)
-	if err != nil {
-		return err
+	if len(c.existingSubnets) > 0 {
+		return c.reconcileExistingSubnets(ec2Client)
+	}
+
+	var cniSubnets []CNISubnet
+	var activeSubnets []CNISubnet
+	for i, cidr := range c.cidrs() {
+		// associate CNI  CIDR to the cluster VPC
+		err := c.associateVPCCidrBlock(ec2Client, cidr)
+		if err != nil {
+			return nil, withReason(key.CIDRAssociationFailedReason, err)
+		}
+
+		// create subnets for CNI in each AZ
+		subnets, err := c.createSubnets(ec2Client, cidr, i)
+		if err != nil {
+			return nil, withReason(key.SubnetCreationFailedReason, err)
+		}
+
+		// only subnets of the newest CIDR are used for new ENIs
+		if i == len(c.cidrs())-1 {
+			for j := range subnets {
+				subnets[j].Active = true
+			}
+			activeSubnets = subnets
+		}
+		cniSubnets = append(cniSubnets, subnets...)
 	}
 
-	// create subnets for CNI in each AZ
-	cniSubnets, err := c.createSubnets(ec2Client)
+	// associate CNI subnets with the cluster private route tables
+	err := c.associateRouteTables(ec2Client, cniSubnets)
 	if err != nil {
-		return err
+		return cniSubnets, withReason(key.RouteTableAssociationFailedReason, err)
 	}
 
 	// apply eni configs to WC k8s
-	err = c.applyENIConfigs(cniSubnets, c.cniSecurityGroupID)
+	err = c.applyENIConfigs(activeSubnets, c.securityGroupIDs())
 	if err != nil {
-		return err
+		return cniSubnets, err
 	}
 
-	return nil
+	// delete ENIConfigs of AZs which are not used by the cluster anymore before their subnets are removed
+	keepENIConfigs := map[string]bool{}
+	for _, s := range activeSubnets {
+		keepENIConfigs[s.AZ] = true
+	}
+	err = c.pruneENIConfigs(context.TODO(), keepENIConfigs)
+	if err != nil {
+		return cniSubnets, withReason(key.ENIConfigApplyFailedReason, err)
+	}
+
+	// delete CNI subnets of AZs which are not used by the cluster anymore once their ENIs are detached,
+	// draining subnets do not affect the CNI of the remaining AZs so they are only reported
+	draining, err := c.pruneSubnets(ec2Client, c.desiredSubnetNames(), false)
+	if err != nil {
+		return cniSubnets, withReason(key.SubnetDeletionFailedReason, err)
+	}
+	cniSubnets = append(cniSubnets, draining...)
+
+	return cniSubnets, nil
+}
+
+// reconcileExistingSubnets will only apply ENIConfigs for the existing subnets, the subnets are validated but never changed
+func (c *CNIService) reconcileExistingSubnets(ec2Client EC2API) ([]CNISubnet, error) {
+	cniSubnets, err := c.resolveExistingSubnets(ec2Client)
+	if err != nil {
+		return nil, withReason(key.SubnetValidationFailedReason, err)
+	}
+
+	err = c.applyENIConfigs(cniSubnets, c.securityGroupIDs())
+	if err != nil {
+		return cniSubnets, err
+	}
+
+	keepENIConfigs := map[string]bool{}
+	for _, s := range cniSubnets {
+		keepENIConfigs[s.AZ] = true
+	}
+	err = c.pruneENIConfigs(context.TODO(), keepENIConfigs)
+	if err != nil {
+		return cniSubnets, withReason(key.ENIConfigApplyFailedReason, err)
+	}
+
+	return cniSubnets, nil
+}
+
+// resolveExistingSubnets will find the existing subnets and check they are in the cluster VPC and in the expected AZ
+func (c *CNIService) resolveExistingSubnets(ec2Client EC2API) ([]CNISubnet, error) {
+	clusterAZs := map[string]bool{}
+	for _, az := range c.vpcAzList {
+		clusterAZs[az] = true
+	}
+
+	var cniSubnets []CNISubnet
+	for _, e := range c.existingSubnets {
+		if !clusterAZs[e.AZ] {
+			return nil, fmt.Errorf("existing subnet for AZ %s does not match any AZ of the cluster", e.AZ)
+		}
+
+		describeInput := &ec2.DescribeSubnetsInput{}
+		if e.ID != "" {
+			describeInput.SubnetIds = aws.StringSlice([]string{e.ID})
+		} else {
+			describeInput.Filters = []*ec2.Filter{
+				{
+					Name:   aws.String("vpc-id"),
+					Values: aws.StringSlice([]string{c.vpcID}),
+				},
+				{
+					Name:   aws.String("availability-zone"),
+					Values: aws.StringSlice([]string{e.AZ}),
+				},
+			}
+			for k, v := range e.Tags {
+				describeInput.Filters = append(describeInput.Filters, &ec2.Filter{
+					Name:   aws.String(fmt.Sprintf("tag:%s", k)),
+					Values: aws.StringSlice([]string{v}),
+				})
+			}
+		}
+
+		o, err := ec2Client.DescribeSubnets(describeInput)
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to describe existing subnet for AZ %s", e.AZ))
+			return nil, err
+		}
+		if len(o.Subnets) != 1 {
+			return nil, fmt.Errorf("expected 1 existing subnet for AZ %s but found %d", e.AZ, len(o.Subnets))
+		}
+
+		subnet := o.Subnets[0]
+		if aws.StringValue(subnet.VpcId) != c.vpcID {
+			return nil, fmt.Errorf("existing subnet %s is in vpc %s, expected %s", aws.StringValue(subnet.SubnetId), aws.StringValue(subnet.VpcId), c.vpcID)
+		}
+		if aws.StringValue(subnet.AvailabilityZone) != e.AZ {
+			return nil, fmt.Errorf("existing subnet %s is in AZ %s, expected %s", aws.StringValue(subnet.SubnetId), aws.StringValue(subnet.AvailabilityZone), e.AZ)
+		}
+
+		cniSubnets = append(cniSubnets, CNISubnet{
+			Active:       true,
+			AZ:           e.AZ,
+			AvailableIPs: aws.Int64Value(subnet.AvailableIpAddressCount),
+			CIDRBlock:    aws.StringValue(subnet.CidrBlock),
+			SubnetID:     aws.StringValue(subnet.SubnetId),
+		})
+	}
+
+	return cniSubnets, nil
+}
+
+// cidrs returns all CNI CIDRs of the cluster, the primary one first
+func (c *CNIService) cidrs() []string {
+	return append([]string{c.cniCIDR}, c.additionalCNICIDRs...)
 }
 
 // associateVPCCidrBlock will add CNI subnet to the cluster VPC
-func (c *CNIService) associateVPCCidrBlock(ec2Client *ec2.EC2) error {
+func (c *CNIService) associateVPCCidrBlock(ec2Client EC2API, cidr string) error {
 	inputDescribe := &ec2.DescribeVpcsInput{VpcIds: aws.StringSlice([]string{c.vpcID})}
 
 	o, err := ec2Client.DescribeVpcs(inputDescribe)
@@ -124,154 +383,394 @@ func (c *CNIService) associateVPCCidrBlock(ec2Client *ec2.EC2) error {
 		c.log.Error(err, "failed to describe VPC")
 		return err
 	}
+	if len(o.Vpcs) == 0 {
+		return awserr.New("InvalidVpcID.NotFound", fmt.Sprintf("the vpc ID '%s' does not exist", c.vpcID), nil)
+	}
 	alreadyAssociated := false
 
-	// check if the cidr is already associated
+	// check if the cidr is already associated, associations which are being removed do not count
 	for _, a := range o.Vpcs[0].CidrBlockAssociationSet {
-		if *a.CidrBlock == c.cniCIDR {
+		if aws.StringValue(a.CidrBlock) == cidr && !isDisassociated(a) {
 			alreadyAssociated = true
 			break
 		}
 	}
 
 	if alreadyAssociated {
-		c.log.Info(fmt.Sprintf("CNI CIDR block %s is already associated with vpc", c.cniCIDR))
+		c.log.Info(fmt.Sprintf("CNI CIDR block %s is already associated with vpc", cidr))
 	} else {
 		i := &ec2.AssociateVpcCidrBlockInput{
 			VpcId:     aws.String(c.vpcID),
-			CidrBlock: aws.String(c.cniCIDR),
+			CidrBlock: aws.String(cidr),
 		}
 		_, err := ec2Client.AssociateVpcCidrBlock(i)
 		if err != nil {
-			c.log.Error(err, fmt.Sprintf("failed to associate VPC cidr block '%s'", c.cniCIDR))
+			c.log.Error(err, fmt.Sprintf("failed to associate VPC cidr block '%s'", cidr))
+			record.Warnf(c.eventObject, "CIDRAssociationFailed", "Failed to associate CNI CIDR block %s with VPC %s: %s", cidr, c.vpcID, err)
 			return err
 		}
-		c.log.Info(fmt.Sprintf("associated new CNI CIDR block %s with vpc", c.cniCIDR))
+		c.log.Info(fmt.Sprintf("associated new CNI CIDR block %s with vpc", cidr))
+		record.Eventf(c.eventObject, "CIDRAssociated", "Associated CNI CIDR block %s with VPC %s", cidr, c.vpcID)
 	}
 
 	return nil
 }
 
 // createSubnets will create subnets for aws cni for each AZ that is used in the cluster
-func (c *CNIService) createSubnets(ec2Client *ec2.EC2) ([]CNISubnet, error) {
+func (c *CNIService) createSubnets(ec2Client EC2API, cidr string, cidrIndex int) ([]CNISubnet, error) {
 	// subnets
 	var cniSubnets []CNISubnet
-	_, cniNetwork, _ := net.ParseCIDR(c.cniCIDR)
-	cniSubnetRanges, err := ipam.Split(*cniNetwork, uint(len(c.vpcAzList)))
+	cniSubnetRanges, err := c.subnetRanges(cidr)
 	if err != nil {
-		c.log.Error(err, fmt.Sprintf("failed to split cni network %s into %d parts", cniNetwork.String(), len(c.vpcAzList)))
+		return nil, err
+	}
+
+	// all subnets in the VPC are needed to find subnets which already occupy the CNI subnet ranges
+	vpcSubnets, err := ec2Client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
+		},
+	})
+	if err != nil {
+		c.log.Error(err, "failed to describe vpc subnets")
 		return nil, err
 	}
 
 	// create AWS CNI subnet for each AZ
 	for i, az := range c.vpcAzList {
+		name := subnetName(c.clusterName, az, cidrIndex)
+
 		// check if the subnet already exists
-		describeInput := &ec2.DescribeSubnetsInput{
-			Filters: []*ec2.Filter{
-				{
-					Name:   aws.String("tag:Name"),
-					Values: aws.StringSlice([]string{subnetName(c.clusterName, az)}),
-				},
+		var named []*ec2.Subnet
+		for _, s := range vpcSubnets.Subnets {
+			if tagValue(s.Tags, "Name") == name && c.isOwnedSubnet(s) {
+				named = append(named, s)
+			}
+		}
+		if len(named) > 1 {
+			return nil, c.subnetConflict(name, cniSubnetRanges[i], named)
+		} else if len(named) == 1 {
+			// subnet already exist, just save the ID and fix its tags
+			err = c.reconcileSubnetTags(ec2Client, named[0], c.subnetTags(az, cidrIndex))
+			if err != nil {
+				return nil, err
+			}
+			cniSubnets = append(cniSubnets, newCNISubnet(az, named[0]))
+			c.log.Info(fmt.Sprintf("cni subnet %s already created with id %s", name, aws.StringValue(named[0].SubnetId)))
+			continue
+		}
+
+		// subnets left behind by a previous cluster with the same name are adopted, any other subnet in the range is a conflict
+		var occupying []*ec2.Subnet
+		for _, s := range vpcSubnets.Subnets {
+			_, r, err := net.ParseCIDR(aws.StringValue(s.CidrBlock))
+			if err == nil && (r.Contains(cniSubnetRanges[i].IP) || cniSubnetRanges[i].Contains(r.IP)) {
+				occupying = append(occupying, s)
+			}
+		}
+		if len(occupying) == 1 && c.isAdoptable(occupying[0], az, cniSubnetRanges[i]) {
+			subnet := occupying[0]
+			err = c.reconcileSubnetTags(ec2Client, subnet, c.subnetTags(az, cidrIndex))
+			if err != nil {
+				return nil, err
+			}
+			cniSubnets = append(cniSubnets, newCNISubnet(az, subnet))
+			c.log.Info(fmt.Sprintf("adopted cni subnet %s with id %s", name, aws.StringValue(subnet.SubnetId)))
+			record.Eventf(c.eventObject, "SubnetAdopted", "Adopted CNI subnet %s with id %s and range %s", name, aws.StringValue(subnet.SubnetId), cniSubnetRanges[i].String())
+			continue
+		} else if len(occupying) > 0 {
+			return nil, c.subnetConflict(name, cniSubnetRanges[i], occupying)
+		}
+
+		// create subnet
+		createInput := &ec2.CreateSubnetInput{
+			VpcId:            aws.String(c.vpcID),
+			AvailabilityZone: aws.String(az),
+			CidrBlock:        aws.String(cniSubnetRanges[i].String()),
+			TagSpecifications: []*ec2.TagSpecification{
 				{
-					Name:   aws.String(fmt.Sprintf("tag:%s", key.AWSCniOperatorOwnedTag)),
-					Values: aws.StringSlice([]string{"owned"}),
+					Tags:         ec2Tags(c.subnetTags(az, cidrIndex)),
+					ResourceType: aws.String("subnet"),
 				},
+			},
+		}
+		o, err := ec2Client.CreateSubnet(createInput)
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to create aws cni subnet for AZ %s with subnet range  %s", az, cniSubnetRanges[i].String()))
+			record.Warnf(c.eventObject, "SubnetCreationFailed", "Failed to create CNI subnet %s with range %s: %s", name, cniSubnetRanges[i].String(), err)
+			return nil, err
+		}
+		cniSubnets = append(cniSubnets, newCNISubnet(az, o.Subnet))
+		c.log.Info(fmt.Sprintf("created cni subnet %s with id %s", name, *o.Subnet.SubnetId))
+		record.Eventf(c.eventObject, "SubnetCreated", "Created CNI subnet %s with id %s and range %s", name, *o.Subnet.SubnetId, cniSubnetRanges[i].String())
+	}
+	return cniSubnets, nil
+}
+
+// isAdoptable returns true when the subnet exactly matches the CNI subnet range of the AZ
+// and is tagged as a CNI subnet of this cluster
+func (c *CNIService) isAdoptable(subnet *ec2.Subnet, az string, subnetRange net.IPNet) bool {
+	return aws.StringValue(subnet.CidrBlock) == subnetRange.String() &&
+		aws.StringValue(subnet.AvailabilityZone) == az &&
+		c.isOwnedSubnet(subnet)
+}
+
+// subnetConflict returns error for subnets which prevent creation of the CNI subnet
+func (c *CNIService) subnetConflict(name string, subnetRange net.IPNet, subnets []*ec2.Subnet) error {
+	var conflicting []string
+	for _, s := range subnets {
+		conflicting = append(conflicting, fmt.Sprintf("%s (%s)", aws.StringValue(s.SubnetId), aws.StringValue(s.CidrBlock)))
+	}
+
+	err := fmt.Errorf("cni subnet %s with range %s conflicts with existing subnets %s", name, subnetRange.String(), strings.Join(conflicting, ", "))
+	c.log.Error(err, "failed to create cni subnet")
+	record.Warnf(c.eventObject, key.SubnetConflictReason, "CNI subnet %s with range %s conflicts with existing subnets %s", name, subnetRange.String(), strings.Join(conflicting, ", "))
+	return withReason(key.SubnetConflictReason, err)
+}
+
+func newCNISubnet(az string, subnet *ec2.Subnet) CNISubnet {
+	return CNISubnet{
+		AZ:           az,
+		AvailableIPs: aws.Int64Value(subnet.AvailableIpAddressCount),
+		CIDRBlock:    aws.StringValue(subnet.CidrBlock),
+		SubnetID:     aws.StringValue(subnet.SubnetId),
+	}
+}
+
+// subnetRanges will compute CNI subnet range for each AZ
+func (c *CNIService) subnetRanges(cidr string) ([]net.IPNet, error) {
+	_, cniNetwork, _ := net.ParseCIDR(cidr)
+
+	if c.subnetMaskSize == 0 {
+		cniSubnetRanges, err := ipam.Split(*cniNetwork, uint(len(c.vpcAzList)))
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to split cni network %s into %d parts", cniNetwork.String(), len(c.vpcAzList)))
+			return nil, err
+		}
+		return cniSubnetRanges, nil
+	}
+
+	var cniSubnetRanges []net.IPNet
+	_, bits := cniNetwork.Mask.Size()
+	mask := net.CIDRMask(c.subnetMaskSize, bits)
+	for range c.vpcAzList {
+		r, err := ipam.Free(*cniNetwork, mask, append([]net.IPNet{}, cniSubnetRanges...))
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to allocate /%d subnets for %d AZs from cni network %s", c.subnetMaskSize, len(c.vpcAzList), cniNetwork.String()))
+			return nil, err
+		}
+		cniSubnetRanges = append(cniSubnetRanges, r)
+	}
+	return cniSubnetRanges, nil
+}
+
+// AdditionalSubnetTags returns the AWSCluster and AWSCNIConfig tags applied to the CNI subnets,
+// they have to be passed as LastAppliedTags to the next reconciliation so removed tags are cleaned up
+func (c *CNIService) AdditionalSubnetTags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range c.clusterTags {
+		tags[k] = v
+	}
+	for k, v := range c.additionalTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// subnetTags returns tags for CNI subnet in the AZ, tags of the operator take precedence over the additional tags
+func (c *CNIService) subnetTags(az string, cidrIndex int) map[string]string {
+	tags := c.AdditionalSubnetTags()
+	tags["Name"] = subnetName(c.clusterName, az, cidrIndex)
+	tags[key.AWSCniOperatorOwnedTag] = "owned"
+	tags[capa.ClusterTagKey(c.clusterName)] = string(capa.ResourceLifecycleOwned)
+	tags[capa.ClusterAWSCloudProviderTagKey(c.clusterName)] = string(capa.ResourceLifecycleOwned)
+	tags[capa.NameAWSClusterAPIRole] = key.CNISubnetRole
+	return tags
+}
+
+// reconcileSubnetTags will add missing tags to the CNI subnet and remove tags which were applied before
+// but are not desired anymore, tags added by anyone else are left untouched
+func (c *CNIService) reconcileSubnetTags(ec2Client EC2API, subnet *ec2.Subnet, desired map[string]string) error {
+	current := map[string]string{}
+	for _, t := range subnet.Tags {
+		current[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+
+	missing := map[string]string{}
+	for k, v := range desired {
+		if value, ok := current[k]; !ok || value != v {
+			missing[k] = v
+		}
+	}
+
+	var stale []*ec2.Tag
+	for k := range c.lastAppliedTags {
+		_, isDesired := desired[k]
+		_, isSet := current[k]
+		if !isDesired && isSet {
+			stale = append(stale, &ec2.Tag{Key: aws.String(k)})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return aws.StringValue(stale[i].Key) < aws.StringValue(stale[j].Key) })
+
+	if len(missing) > 0 {
+		_, err := ec2Client.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{subnet.SubnetId},
+			Tags:      ec2Tags(missing),
+		})
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to tag cni subnet %s", aws.StringValue(subnet.SubnetId)))
+			record.Warnf(c.eventObject, "SubnetTaggingFailed", "Failed to tag CNI subnet %s: %s", aws.StringValue(subnet.SubnetId), err)
+			return err
+		}
+	}
+
+	if len(stale) > 0 {
+		_, err := ec2Client.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: []*string{subnet.SubnetId},
+			Tags:      stale,
+		})
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to remove stale tags from cni subnet %s", aws.StringValue(subnet.SubnetId)))
+			record.Warnf(c.eventObject, "SubnetTaggingFailed", "Failed to remove stale tags from CNI subnet %s: %s", aws.StringValue(subnet.SubnetId), err)
+			return err
+		}
+	}
+
+	if len(missing) > 0 || len(stale) > 0 {
+		c.log.Info(fmt.Sprintf("updated tags of cni subnet %s, set %d and removed %d tags", aws.StringValue(subnet.SubnetId), len(missing), len(stale)))
+		record.Eventf(c.eventObject, "SubnetTagsUpdated", "Updated tags of CNI subnet %s", aws.StringValue(subnet.SubnetId))
+	}
+	return nil
+}
+
+// securityGroupIDs returns all security groups for pod ENIs
+func (c *CNIService) securityGroupIDs() []string {
+	return append([]string{c.cniSecurityGroupID}, c.additionalSecurityGroupIDs...)
+}
+
+// associateRouteTables will associate each CNI subnet with the private route table of its AZ
+func (c *CNIService) associateRouteTables(ec2Client EC2API, subnets []CNISubnet) error {
+	for _, s := range subnets {
+		routeTableID, ok := c.routeTableIDs[s.AZ]
+		if !ok || routeTableID == "" {
+			c.log.Info(fmt.Sprintf("no private route table found for AZ %s, cni subnet %s will use the vpc main route table", s.AZ, s.SubnetID))
+			continue
+		}
+
+		describeInput := &ec2.DescribeRouteTablesInput{
+			Filters: []*ec2.Filter{
 				{
 					Name:   aws.String("vpc-id"),
 					Values: aws.StringSlice([]string{c.vpcID}),
 				},
+				{
+					Name:   aws.String("association.subnet-id"),
+					Values: aws.StringSlice([]string{s.SubnetID}),
+				},
 			},
 		}
-		o, err := ec2Client.DescribeSubnets(describeInput)
+		o, err := ec2Client.DescribeRouteTables(describeInput)
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to describe route tables for subnet %s", s.SubnetID))
+			return err
+		}
 
-		if err == nil && len(o.Subnets) == 1 {
-			// subnet already exist, just save the ID
-			cniSubnets = append(cniSubnets, CNISubnet{
-				SubnetID: *o.Subnets[0].SubnetId,
-				AZ:       az,
-			})
-			c.log.Info(fmt.Sprintf("cni subnet %s already created with id %s", subnetName(c.clusterName, az), *o.Subnets[0].SubnetId))
-
-		} else if err == nil {
-			// create subnet
-			createInput := &ec2.CreateSubnetInput{
-				VpcId:            aws.String(c.vpcID),
-				AvailabilityZone: aws.String(az),
-				CidrBlock:        aws.String(cniSubnetRanges[i].String()),
-				TagSpecifications: []*ec2.TagSpecification{
-					{
-						Tags: []*ec2.Tag{
-							{
-								Key:   aws.String("Name"),
-								Value: aws.String(subnetName(c.clusterName, az)),
-							},
-							{
-								Key:   aws.String(key.AWSCniOperatorOwnedTag),
-								Value: aws.String("owned"),
-							},
-						},
-						ResourceType: aws.String("subnet"),
-					},
-				},
+		var associationID, currentRouteTableID string
+		for _, rt := range o.RouteTables {
+			for _, a := range rt.Associations {
+				if aws.StringValue(a.SubnetId) == s.SubnetID {
+					associationID = aws.StringValue(a.RouteTableAssociationId)
+					currentRouteTableID = aws.StringValue(a.RouteTableId)
+				}
+			}
+		}
+
+		if currentRouteTableID == routeTableID {
+			c.log.Info(fmt.Sprintf("cni subnet %s is already associated with route table %s", s.SubnetID, routeTableID))
+		} else if associationID != "" {
+			// association drifted, point it back to the expected route table
+			i := &ec2.ReplaceRouteTableAssociationInput{
+				AssociationId: aws.String(associationID),
+				RouteTableId:  aws.String(routeTableID),
 			}
-			o, err := ec2Client.CreateSubnet(createInput)
+			_, err := ec2Client.ReplaceRouteTableAssociation(i)
 			if err != nil {
-				c.log.Error(err, fmt.Sprintf("failed to create aws cni subnet for AZ %s with subnet range  %s", az, cniSubnetRanges[i].String()))
-				return nil, err
+				c.log.Error(err, fmt.Sprintf("failed to replace route table association for subnet %s", s.SubnetID))
+				return err
 			}
-			cniSubnets = append(cniSubnets, CNISubnet{
-				SubnetID: *o.Subnet.SubnetId,
-				AZ:       az,
-			})
-			c.log.Info(fmt.Sprintf("created cni subnet %s with id %s", subnetName(c.clusterName, az), *o.Subnet.SubnetId))
+			c.log.Info(fmt.Sprintf("replaced route table %s with %s for cni subnet %s", currentRouteTableID, routeTableID, s.SubnetID))
+			record.Eventf(c.eventObject, "RouteTableAssociated", "Replaced route table %s with %s for CNI subnet %s", currentRouteTableID, routeTableID, s.SubnetID)
 		} else {
-			c.log.Error(err, fmt.Sprintf("failed to describe subnet %s", subnetName(c.clusterName, az)))
-			return nil, err
+			i := &ec2.AssociateRouteTableInput{
+				RouteTableId: aws.String(routeTableID),
+				SubnetId:     aws.String(s.SubnetID),
+			}
+			_, err := ec2Client.AssociateRouteTable(i)
+			if err != nil {
+				c.log.Error(err, fmt.Sprintf("failed to associate route table %s with subnet %s", routeTableID, s.SubnetID))
+				return err
+			}
+			c.log.Info(fmt.Sprintf("associated cni subnet %s with route table %s", s.SubnetID, routeTableID))
+			record.Eventf(c.eventObject, "RouteTableAssociated", "Associated CNI subnet %s with route table %s", s.SubnetID, routeTableID)
 		}
 	}
-	return cniSubnets, nil
+
+	return nil
 }
 
 // applyENIConfigs will create or update ENIConfigs in the WC k8s api
-func (c *CNIService) applyENIConfigs(subnets []CNISubnet, securityGroupID string) error {
+func (c *CNIService) applyENIConfigs(subnets []CNISubnet, securityGroupIDs []string) error {
 	ctx := context.TODO()
 
 	for _, s := range subnets {
+		annotations := map[string]string{}
+		for k, v := range c.eniConfigAnnotations {
+			annotations[k] = v
+		}
+		annotations[eniConfigDocsAnnotation] = eniConfigDocsURL
+
+		labels := map[string]string{}
+		for k, v := range c.eniConfigLabels {
+			labels[k] = v
+		}
+		labels[key.ManagedByLabel] = key.ManagedByLabelValue
+
 		eniConfig := &v1alpha1.ENIConfig{
 			TypeMeta: metav1.TypeMeta{
 				APIVersion: v1alpha1.SchemeGroupVersion.String(),
 				Kind:       "ENIConfig",
 			},
 			ObjectMeta: metav1.ObjectMeta{
-				Annotations: map[string]string{
-					"giantswarm.io/docs": "https://godoc.org/github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1#ENIConfig",
-				},
-				Name:      s.AZ,
-				Namespace: corev1.NamespaceDefault,
+				Annotations: annotations,
+				Labels:      labels,
+				Name:        s.AZ,
+				Namespace:   corev1.NamespaceDefault,
 			},
 			Spec: v1alpha1.ENIConfigSpec{
-				SecurityGroups: []string{
-					securityGroupID,
-				},
-				Subnet: s.SubnetID,
+				SecurityGroups: securityGroupIDs,
+				Subnet:         s.SubnetID,
 			},
 		}
 
 		err := c.ctrlClient.Create(ctx, eniConfig)
 		// check if wc k8s api is up yet
-		if IsApiNotReadyYet(err) {
-			c.log.Info("WC k8s api is not read yet")
-			return errors.New("WC k8s api is not read yet")
+		if IsAPINotReady(err) {
+			c.log.Info(fmt.Sprintf("WC k8s api is not ready yet: %s", err))
+			return withReason(key.WaitingForWorkloadAPIReason, withCause(ErrWorkloadAPINotReady, err))
 		} else if IsENIConfigNotRegistered(err) {
-			c.log.Info("WC k8s api do not have ENIConfig CRD yet")
-			return errors.New("WC k8s api do not have ENIConfig CRD yet")
+			c.log.Info("WC k8s api does not have ENIConfig CRD yet")
+			return withReason(key.ENIConfigCRDMissingReason, withCause(ErrENIConfigNotRegistered, err))
 		} else if k8serrors.IsAlreadyExists(err) {
 			var latest v1alpha1.ENIConfig
 
 			err := c.ctrlClient.Get(ctx, types.NamespacedName{Name: eniConfig.GetName(), Namespace: eniConfig.GetNamespace()}, &latest)
 			if err != nil {
 				c.log.Error(err, "failed to get eni configs")
-				return err
+				return withReason(key.ENIConfigApplyFailedReason, err)
 			}
 
 			eniConfig.ResourceVersion = latest.GetResourceVersion()
@@ -279,11 +778,19 @@ func (c *CNIService) applyENIConfigs(subnets []CNISubnet, securityGroupID string
 			err = c.ctrlClient.Update(ctx, eniConfig)
 			if err != nil {
 				c.log.Error(err, "failed to update eni config")
-				return err
+				record.Warnf(c.eventObject, "ENIConfigUpdateFailed", "Failed to update ENIConfig %s: %s", eniConfig.Name, err)
+				return withReason(key.ENIConfigApplyFailedReason, err)
+			}
+			// only record an event when the ENIConfig actually changed to avoid an event on every reconciliation
+			if !reflect.DeepEqual(latest.Spec, eniConfig.Spec) {
+				record.Eventf(c.eventObject, "ENIConfigUpdated", "Updated ENIConfig %s with subnet %s", eniConfig.Name, s.SubnetID)
 			}
 		} else if err != nil {
 			c.log.Error(err, "failed to create eni config")
-			return err
+			record.Warnf(c.eventObject, "ENIConfigCreationFailed", "Failed to create ENIConfig %s: %s", eniConfig.Name, err)
+			return withReason(key.ENIConfigApplyFailedReason, err)
+		} else {
+			record.Eventf(c.eventObject, "ENIConfigCreated", "Created ENIConfig %s with subnet %s", eniConfig.Name, s.SubnetID)
 		}
 	}
 	c.log.Info("applied ENIConfigs for aws cni")
@@ -291,69 +798,345 @@ func (c *CNIService) applyENIConfigs(subnets []CNISubnet, securityGroupID string
 	return nil
 }
 
+// pruneENIConfigs will delete all ENIConfigs managed by the operator which are not in the keep set, ENIConfigs
+// created before they were labeled are kept when they are in the keep set as they are labeled by applyENIConfigs
+func (c *CNIService) pruneENIConfigs(ctx context.Context, keep map[string]bool) error {
+	var eniConfigs v1alpha1.ENIConfigList
+	err := c.ctrlClient.List(ctx, &eniConfigs, client.InNamespace(corev1.NamespaceDefault))
+	if err != nil {
+		c.log.Error(err, "failed to list eni configs")
+		return err
+	}
+
+	for i := range eniConfigs.Items {
+		eniConfig := &eniConfigs.Items[i]
+		if keep[eniConfig.Name] || !c.isManagedENIConfig(eniConfig) {
+			continue
+		}
+
+		err := c.ctrlClient.Delete(ctx, eniConfig)
+		if k8serrors.IsNotFound(err) {
+			// already deleted
+		} else if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to delete eni config %s", eniConfig.Name))
+			record.Warnf(c.eventObject, "ENIConfigDeletionFailed", "Failed to delete ENIConfig %s: %s", eniConfig.Name, err)
+			return err
+		} else {
+			c.log.Info(fmt.Sprintf("deleted eni config %s", eniConfig.Name))
+			record.Eventf(c.eventObject, "ENIConfigDeleted", "Deleted ENIConfig %s with subnet %s", eniConfig.Name, eniConfig.Spec.Subnet)
+		}
+	}
+
+	return nil
+}
+
+// isManagedENIConfig returns true for ENIConfigs created by the operator, ENIConfigs created before they were
+// labeled are recognized by the docs annotation and their name being an AZ of the cluster region
+func (c *CNIService) isManagedENIConfig(eniConfig *v1alpha1.ENIConfig) bool {
+	if eniConfig.Labels[key.ManagedByLabel] == key.ManagedByLabelValue {
+		return true
+	}
+	if _, ok := eniConfig.Labels[key.ManagedByLabel]; ok || eniConfig.Annotations[eniConfigDocsAnnotation] != eniConfigDocsURL {
+		return false
+	}
+
+	// AZ names are the region followed by a single letter, e.g. eu-west-1a
+	name := eniConfig.Name
+	if len(name) < 2 || name[len(name)-1] < 'a' || name[len(name)-1] > 'z' {
+		return false
+	}
+	for _, az := range c.vpcAzList {
+		if len(az) >= 2 && az[:len(az)-1] == name[:len(name)-1] {
+			return true
+		}
+	}
+	return false
+}
+
 // Delete will clean any remaining CNI resources in WC VPC
 func (c *CNIService) Delete() error {
-	ec2Client := ec2.New(c.awsSession)
+	ec2Client := c.ec2Client
 
-	err := c.deleteSubnets(ec2Client)
-	if err != nil {
-		return err
+	// WC k8s api might not be available anymore when the cluster is being deleted, so this is best effort only
+	if c.ctrlClient != nil {
+		ctx, cancel := context.WithTimeout(context.TODO(), eniConfigDeletionTimeout)
+		err := c.pruneENIConfigs(ctx, nil)
+		cancel()
+		if err != nil {
+			c.log.Info(fmt.Sprintf("failed to delete ENIConfigs from WC k8s api, skipping: %s", err))
+		}
+	}
+
+	// existing subnets and the VPC CIDRs are not managed by the operator
+	if len(c.existingSubnets) > 0 {
+		return nil
 	}
 
-	err = key.CleanWCK8sKubeconfig(c.clusterName)
+	// delete all CNI subnets of the cluster, including those of AZs which were removed from the cluster
+	_, err := c.pruneSubnets(ec2Client, nil, true)
 	if err != nil {
-		c.log.Error(err, fmt.Sprintf("failed to delete local kubeconfig file for cluster %s", c.clusterName))
 		return err
 	}
 
+	for _, cidr := range c.cidrs() {
+		err = c.disassociateVPCCidrBlock(ec2Client, cidr)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// deleteSubnets will delete all CNI subnets from cluster VPC
-func (c *CNIService) deleteSubnets(ec2Client *ec2.EC2) error {
-	for _, az := range c.vpcAzList {
-		describeInput := &ec2.DescribeSubnetsInput{
-			Filters: []*ec2.Filter{
-				{
-					Name:   aws.String("tag:Name"),
-					Values: aws.StringSlice([]string{subnetName(c.clusterName, az)}),
-				},
-				{
-					Name:   aws.String(fmt.Sprintf("tag:%s", key.AWSCniOperatorOwnedTag)),
-					Values: aws.StringSlice([]string{"owned"}),
-				},
-			},
+// pruneSubnets will delete all CNI subnets of the cluster in the VPC which are not in the keep set and return those
+// which are kept because network interfaces are still attached to instances, they are only deleted when force is set
+func (c *CNIService) pruneSubnets(ec2Client EC2API, keep map[string]bool, force bool) ([]CNISubnet, error) {
+	subnets, err := c.listOwnedSubnets(ec2Client)
+	if err != nil {
+		return nil, err
+	}
+
+	var draining []CNISubnet
+	for _, subnet := range subnets {
+		name := tagValue(subnet.Tags, "Name")
+		if keep[name] {
+			continue
 		}
-		o, err := ec2Client.DescribeSubnets(describeInput)
+
+		// never delete a subnet which does not belong to the cluster, even if the describe filters matched it
+		if !c.isOwnedSubnet(subnet) {
+			err := fmt.Errorf("refusing to delete subnet %s in vpc %s, it is not tagged as cni subnet of cluster %s", aws.StringValue(subnet.SubnetId), aws.StringValue(subnet.VpcId), c.clusterName)
+			c.log.Error(err, "failed to delete cni subnet")
+			record.Warnf(c.eventObject, "SubnetDeletionRefused", "Refused to delete subnet %s which is not tagged as CNI subnet of cluster %s", aws.StringValue(subnet.SubnetId), c.clusterName)
+			return nil, err
+		}
+
+		networkInterfaces, err := c.describeSubnetNetworkInterfaces(ec2Client, *subnet.SubnetId)
 		if err != nil {
-			c.log.Error(err, fmt.Sprintf("failed to describe subnet %s", subnetName(c.clusterName, az)))
-			return err
+			return nil, err
 		}
 
-		if len(o.Subnets) != 0 {
-			err := c.deleteSubnetNetworkInterfaces(ec2Client, *o.Subnets[0].SubnetId)
-			if err != nil {
-				return err
-			}
+		// pods on nodes which are still running in the AZ keep using their ENIs until the nodes are gone
+		if !force && hasAttachedNetworkInterfaces(networkInterfaces) {
+			c.log.Info(fmt.Sprintf("cni subnet %s with id %s still has attached network interfaces, waiting for them to be drained", name, *subnet.SubnetId))
+			s := newCNISubnet(aws.StringValue(subnet.AvailabilityZone), subnet)
+			s.Draining = true
+			draining = append(draining, s)
+			continue
+		}
 
-			delInput := &ec2.DeleteSubnetInput{
-				SubnetId: o.Subnets[0].SubnetId,
-			}
+		err = c.deleteNetworkInterfaces(ec2Client, networkInterfaces)
+		if err != nil {
+			return nil, err
+		}
 
-			_, err = ec2Client.DeleteSubnet(delInput)
-			if err != nil {
-				c.log.Error(err, fmt.Sprintf("failed to delete subnet %s", subnetName(c.clusterName, az)))
-				return err
+		delInput := &ec2.DeleteSubnetInput{
+			SubnetId: subnet.SubnetId,
+		}
+
+		_, err = ec2Client.DeleteSubnet(delInput)
+		if err != nil {
+			c.log.Error(err, fmt.Sprintf("failed to delete subnet %s", name))
+			record.Warnf(c.eventObject, "SubnetDeletionFailed", "Failed to delete CNI subnet %s: %s", name, err)
+			return nil, err
+		}
+		c.log.Info(fmt.Sprintf("deleted cni subnet %s with id %s", name, *subnet.SubnetId))
+		record.Eventf(c.eventObject, "SubnetDeleted", "Deleted CNI subnet %s with id %s", name, *subnet.SubnetId)
+	}
+
+	return draining, nil
+}
+
+// listOwnedSubnets returns all CNI subnets of the cluster in the VPC
+func (c *CNIService) listOwnedSubnets(ec2Client EC2API) ([]*ec2.Subnet, error) {
+	describeInput := &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", capa.ClusterTagKey(c.clusterName))),
+				Values: aws.StringSlice([]string{string(capa.ResourceLifecycleOwned)}),
+			},
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", key.AWSCniOperatorOwnedTag)),
+				Values: aws.StringSlice([]string{"owned"}),
+			},
+		},
+	}
+	o, err := ec2Client.DescribeSubnets(describeInput)
+	if err != nil {
+		c.log.Error(err, fmt.Sprintf("failed to describe cni subnets in vpc %s", c.vpcID))
+		return nil, err
+	}
+
+	// subnets created before the cluster tag was introduced are only found by their name
+	legacyDescribeInput := &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", key.AWSCniOperatorOwnedTag)),
+				Values: aws.StringSlice([]string{"owned"}),
+			},
+			{
+				Name:   aws.String("tag:Name"),
+				Values: aws.StringSlice([]string{subnetNamePrefix(c.clusterName) + "*"}),
+			},
+		},
+	}
+	legacy, err := ec2Client.DescribeSubnets(legacyDescribeInput)
+	if err != nil {
+		c.log.Error(err, fmt.Sprintf("failed to describe legacy cni subnets in vpc %s", c.vpcID))
+		return nil, err
+	}
+
+	var subnets []*ec2.Subnet
+	found := map[string]bool{}
+	for _, subnet := range o.Subnets {
+		// other subnets of the cluster, e.g. those created by CAPA, carry the same cluster tag
+		if strings.HasPrefix(tagValue(subnet.Tags, "Name"), subnetNamePrefix(c.clusterName)) {
+			subnets = append(subnets, subnet)
+			found[aws.StringValue(subnet.SubnetId)] = true
+		}
+	}
+	for _, subnet := range legacy.Subnets {
+		if !found[aws.StringValue(subnet.SubnetId)] && isLegacySubnet(subnet) {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets, nil
+}
+
+// isOwnedSubnet returns true when the subnet is in the cluster VPC and tagged as a CNI subnet of the cluster,
+// subnets created before the cluster tag was introduced must not carry the cluster tag of any cluster
+func (c *CNIService) isOwnedSubnet(subnet *ec2.Subnet) bool {
+	if aws.StringValue(subnet.VpcId) != c.vpcID ||
+		tagValue(subnet.Tags, key.AWSCniOperatorOwnedTag) != "owned" ||
+		!strings.HasPrefix(tagValue(subnet.Tags, "Name"), subnetNamePrefix(c.clusterName)) {
+		return false
+	}
+
+	return tagValue(subnet.Tags, capa.ClusterTagKey(c.clusterName)) == string(capa.ResourceLifecycleOwned) || isLegacySubnet(subnet)
+}
+
+// isLegacySubnet returns true for subnets without the cluster tag of any cluster
+func isLegacySubnet(subnet *ec2.Subnet) bool {
+	for _, t := range subnet.Tags {
+		if strings.HasPrefix(aws.StringValue(t.Key), capa.NameAWSProviderOwned) {
+			return false
+		}
+	}
+	return true
+}
+
+// desiredSubnetNames returns names of all CNI subnets the cluster should have
+func (c *CNIService) desiredSubnetNames() map[string]bool {
+	names := map[string]bool{}
+	for i := range c.cidrs() {
+		for _, az := range c.vpcAzList {
+			names[subnetName(c.clusterName, az, i)] = true
+		}
+	}
+	return names
+}
+
+// disassociateVPCCidrBlock will remove CNI CIDR block from the cluster VPC
+func (c *CNIService) disassociateVPCCidrBlock(ec2Client EC2API, cidr string) error {
+	inputDescribe := &ec2.DescribeVpcsInput{VpcIds: aws.StringSlice([]string{c.vpcID})}
+
+	o, err := ec2Client.DescribeVpcs(inputDescribe)
+	if IsVPCNotFound(err) {
+		c.log.Info(fmt.Sprintf("vpc %s is already deleted, nothing to disassociate", c.vpcID))
+		return nil
+	} else if err != nil {
+		c.log.Error(err, "failed to describe VPC")
+		return err
+	}
+
+	var associationID string
+	for _, vpc := range o.Vpcs {
+		for _, a := range vpc.CidrBlockAssociationSet {
+			if aws.StringValue(a.CidrBlock) != cidr || isDisassociated(a) {
+				continue
 			}
+			associationID = aws.StringValue(a.AssociationId)
+		}
+	}
+
+	if associationID == "" {
+		c.log.Info(fmt.Sprintf("CNI CIDR block %s is not associated with vpc", cidr))
+		return nil
+	}
+
+	// CIDR block cannot be disassociated while there are still subnets in it
+	_, cniNetwork, _ := net.ParseCIDR(cidr)
+	describeInput := &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
+		},
+	}
+	subnets, err := ec2Client.DescribeSubnets(describeInput)
+	if err != nil {
+		c.log.Error(err, fmt.Sprintf("failed to describe subnets in vpc %s", c.vpcID))
+		return err
+	}
+	var inUse []string
+	for _, s := range subnets.Subnets {
+		ip, _, err := net.ParseCIDR(aws.StringValue(s.CidrBlock))
+		if err == nil && cniNetwork.Contains(ip) {
+			inUse = append(inUse, aws.StringValue(s.SubnetId))
 		}
 	}
+	// CNI subnets are deleted before, so these are subnets created by someone else which have to be removed by their owner
+	if len(inUse) > 0 {
+		err := fmt.Errorf("CNI CIDR block %s is used by subnets %s", cidr, strings.Join(inUse, ", "))
+		c.log.Info(fmt.Sprintf("cannot disassociate CNI CIDR block: %s", err))
+		record.Warnf(c.eventObject, key.CIDRInUseReason, "Cannot disassociate CNI CIDR block %s from VPC %s, it is used by subnets %s", cidr, c.vpcID, strings.Join(inUse, ", "))
+		return withReason(key.CIDRInUseReason, withCause(ErrCIDRInUse, err))
+	}
+
+	i := &ec2.DisassociateVpcCidrBlockInput{
+		AssociationId: aws.String(associationID),
+	}
+	_, err = ec2Client.DisassociateVpcCidrBlock(i)
+	if IsVPCNotFound(err) || IsCidrAssociationNotFound(err) {
+		c.log.Info(fmt.Sprintf("CNI CIDR block %s association is already gone", cidr))
+		return nil
+	} else if err != nil {
+		c.log.Error(err, fmt.Sprintf("failed to disassociate VPC cidr block '%s'", cidr))
+		record.Warnf(c.eventObject, "CIDRDisassociationFailed", "Failed to disassociate CNI CIDR block %s from VPC %s: %s", cidr, c.vpcID, err)
+		return err
+	}
+	c.log.Info(fmt.Sprintf("disassociated CNI CIDR block %s from vpc", cidr))
+	record.Eventf(c.eventObject, "CIDRDisassociated", "Disassociated CNI CIDR block %s from VPC %s", cidr, c.vpcID)
+
 	return nil
 }
 
-// deleteSubnetNetworkInterfaces delete any remaining network interfaces from a subnet
-func (c *CNIService) deleteSubnetNetworkInterfaces(ec2Client *ec2.EC2, subnetID string) error {
+// isDisassociated returns true when the VPC CIDR block association is being removed or already removed
+func isDisassociated(a *ec2.VpcCidrBlockAssociation) bool {
+	if a.CidrBlockState == nil {
+		return false
+	}
+	state := aws.StringValue(a.CidrBlockState.State)
+	return state == ec2.VpcCidrBlockStateCodeDisassociating || state == ec2.VpcCidrBlockStateCodeDisassociated
+}
+
+// describeSubnetNetworkInterfaces returns all network interfaces in the subnet
+func (c *CNIService) describeSubnetNetworkInterfaces(ec2Client EC2API, subnetID string) ([]*ec2.NetworkInterface, error) {
 	i := &ec2.DescribeNetworkInterfacesInput{
 		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
 			{
 				Name:   aws.String("subnet-id"),
 				Values: aws.StringSlice([]string{subnetID}),
@@ -364,24 +1147,31 @@ func (c *CNIService) deleteSubnetNetworkInterfaces(ec2Client *ec2.EC2, subnetID
 	o, err := ec2Client.DescribeNetworkInterfaces(i)
 	if err != nil {
 		c.log.Error(err, "failed to describe network interfaces")
-		return err
+		return nil, err
 	}
+	return o.NetworkInterfaces, nil
+}
 
+// deleteNetworkInterfaces detaches and deletes the network interfaces
+func (c *CNIService) deleteNetworkInterfaces(ec2Client EC2API, networkInterfaces []*ec2.NetworkInterface) error {
 	//detach ENIs
-	for _, eni := range o.NetworkInterfaces {
+	for _, eni := range networkInterfaces {
 		if eni.Attachment != nil {
 			detachInput := &ec2.DetachNetworkInterfaceInput{
 				Force:        aws.Bool(true),
 				AttachmentId: eni.Attachment.AttachmentId,
 			}
 			// we ignore errors on detach in case the ENI was already detached or is detaching
-			_, _ = ec2Client.DetachNetworkInterface(detachInput)
+			_, err := ec2Client.DetachNetworkInterface(detachInput)
+			if err != nil {
+				record.Warnf(c.eventObject, "ENIDetachFailed", "Failed to detach network interface %s: %s", aws.StringValue(eni.NetworkInterfaceId), err)
+			}
 		}
 
 	}
 
 	//delete ENIs
-	for _, eni := range o.NetworkInterfaces {
+	for _, eni := range networkInterfaces {
 		delInput := &ec2.DeleteNetworkInterfaceInput{
 			NetworkInterfaceId: eni.NetworkInterfaceId,
 		}
@@ -389,6 +1179,7 @@ func (c *CNIService) deleteSubnetNetworkInterfaces(ec2Client *ec2.EC2, subnetID
 		_, err := ec2Client.DeleteNetworkInterface(delInput)
 		if err != nil {
 			c.log.Error(err, fmt.Sprintf("failed to delete network interface %s", *eni.NetworkInterfaceId))
+			record.Warnf(c.eventObject, "ENIDeletionFailed", "Failed to delete network interface %s: %s", *eni.NetworkInterfaceId, err)
 			return err
 		}
 	}
@@ -396,6 +1187,49 @@ func (c *CNIService) deleteSubnetNetworkInterfaces(ec2Client *ec2.EC2, subnetID
 	return nil
 }
 
-func subnetName(clusterName string, azName string) string {
-	return fmt.Sprintf("%s-subnet-cni-%s", clusterName, azName)
+// hasAttachedNetworkInterfaces returns true when any of the network interfaces is attached to an instance
+func hasAttachedNetworkInterfaces(networkInterfaces []*ec2.NetworkInterface) bool {
+	for _, eni := range networkInterfaces {
+		if eni.Attachment != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetNamePrefix returns common name prefix of all CNI subnets of the cluster
+func subnetNamePrefix(clusterName string) string {
+	return fmt.Sprintf("%s-subnet-cni-", clusterName)
+}
+
+// subnetName returns name of the CNI subnet, subnets of additional CNI CIDRs are suffixed with the CIDR index
+func subnetName(clusterName string, azName string, cidrIndex int) string {
+	if cidrIndex > 0 {
+		return fmt.Sprintf("%s%s-%d", subnetNamePrefix(clusterName), azName, cidrIndex)
+	}
+	return fmt.Sprintf("%s%s", subnetNamePrefix(clusterName), azName)
+}
+
+// ec2Tags converts the tag map to ec2 tags sorted by key
+func ec2Tags(tags map[string]string) []*ec2.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ec2Tags []*ec2.Tag
+	for _, k := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return ec2Tags
+}
+
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
 }
@@ -0,0 +1,1190 @@
+package cni_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	eniv1alpha1 "github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni/fake"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+)
+
+const (
+	clusterName = "test"
+	cniCIDR     = "100.64.0.0/16"
+)
+
+// mutatingOperations are all EC2 operations which change AWS resources
+var mutatingOperations = []string{
+	"AssociateRouteTable",
+	"AssociateVpcCidrBlock",
+	"CreateSubnet",
+	"CreateTags",
+	"DeleteNetworkInterface",
+	"DeleteSubnet",
+	"DeleteTags",
+	"DetachNetworkInterface",
+	"DisassociateVpcCidrBlock",
+	"ReplaceRouteTableAssociation",
+}
+
+type testCluster struct {
+	ec2Client     *fake.EC2
+	wcClient      client.Client
+	vpcID         string
+	azs           []string
+	routeTableIDs map[string]string
+}
+
+func newTestCluster(t *testing.T, azs []string) *testCluster {
+	scheme := runtime.NewScheme()
+	err := eniv1alpha1.AddToScheme(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCluster{
+		ec2Client:     fake.NewEC2(),
+		wcClient:      fakeclient.NewFakeClientWithScheme(scheme),
+		azs:           azs,
+		routeTableIDs: map[string]string{},
+	}
+	c.vpcID = c.ec2Client.AddVPC("10.0.0.0/16")
+	for _, az := range azs {
+		c.routeTableIDs[az] = c.ec2Client.AddRouteTable(c.vpcID)
+	}
+	return c
+}
+
+// service returns the CNI service of the cluster, the config can be changed by the options
+func (c *testCluster) service(t *testing.T, options ...func(config *cni.CNIConfig)) *cni.CNIService {
+	config := cni.CNIConfig{
+		ClusterName:        clusterName,
+		CNICIDR:            cniCIDR,
+		CNISecurityGroupID: "sg-0123456789abcdef0",
+		CtrlClient:         c.wcClient,
+		EC2Client:          c.ec2Client,
+		EventObject:        &capa.AWSCluster{},
+		Log:                ctrllog.NullLogger{},
+		RouteTableIDs:      c.routeTableIDs,
+		VPCAzList:          c.azs,
+		VPCID:              c.vpcID,
+	}
+	for _, o := range options {
+		o(&config)
+	}
+
+	s, err := cni.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// eniConfigs returns the ENIConfigs in the WC k8s api by name
+func (c *testCluster) eniConfigs(t *testing.T) map[string]eniv1alpha1.ENIConfig {
+	var eniConfigs eniv1alpha1.ENIConfigList
+	err := c.wcClient.List(context.Background(), &eniConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]eniv1alpha1.ENIConfig{}
+	for _, e := range eniConfigs.Items {
+		byName[e.Name] = e
+	}
+	return byName
+}
+
+func (c *testCluster) cidrAssociated() bool {
+	vpc := c.ec2Client.VPC(c.vpcID)
+	if vpc == nil {
+		return false
+	}
+	for _, a := range vpc.CidrBlockAssociationSet {
+		if aws.StringValue(a.CidrBlock) == cniCIDR {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_Reconcile(t *testing.T) {
+	testCases := []struct {
+		name string
+		azs  []string
+		// setup prepares the EC2 backend before the first reconciliation
+		setup          func(c *testCluster)
+		expectedReason string
+	}{
+		{
+			name: "case 0: create resources for a single AZ",
+			azs:  []string{"eu-west-1a"},
+		},
+		{
+			name: "case 1: create resources for three AZs",
+			azs:  []string{"eu-west-1a", "eu-west-1b", "eu-west-1c"},
+		},
+		{
+			name: "case 2: subnet creation fails",
+			azs:  []string{"eu-west-1a", "eu-west-1b"},
+			setup: func(c *testCluster) {
+				c.ec2Client.Fail("CreateSubnet", awserr.New("InsufficientFreeAddressesInSubnet", "no free addresses", nil))
+			},
+			expectedReason: key.SubnetCreationFailedReason,
+		},
+		{
+			name: "case 3: cidr association fails",
+			azs:  []string{"eu-west-1a"},
+			setup: func(c *testCluster) {
+				c.ec2Client.Fail("AssociateVpcCidrBlock", awserr.New("CidrLimitExceeded", "too many cidr blocks", nil))
+			},
+			expectedReason: key.CIDRAssociationFailedReason,
+		},
+		{
+			name: "case 4: route table association fails",
+			azs:  []string{"eu-west-1a"},
+			setup: func(c *testCluster) {
+				c.ec2Client.Fail("AssociateRouteTable", awserr.New("InternalError", "internal error", nil))
+			},
+			expectedReason: key.RouteTableAssociationFailedReason,
+		},
+		{
+			name: "case 5: subnet range is occupied by a foreign subnet",
+			azs:  []string{"eu-west-1a"},
+			setup: func(c *testCluster) {
+				c.ec2Client.AddSubnet(c.vpcID, "eu-west-1a", "100.64.0.0/24", map[string]string{"Name": "foreign"})
+			},
+			expectedReason: key.SubnetConflictReason,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, tc.azs)
+			if tc.setup != nil {
+				tc.setup(c)
+			}
+
+			subnets, err := c.service(t).Reconcile()
+			if tc.expectedReason != "" {
+				if err == nil {
+					t.Fatalf("expected error with reason %s, got nil", tc.expectedReason)
+				}
+				if cni.Reason(err) != tc.expectedReason {
+					t.Fatalf("expected reason %s, got %s: %s", tc.expectedReason, cni.Reason(err), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !c.cidrAssociated() {
+				t.Fatalf("expected cidr %s to be associated with vpc", cniCIDR)
+			}
+			if len(subnets) != len(tc.azs) {
+				t.Fatalf("expected %d cni subnets, got %d", len(tc.azs), len(subnets))
+			}
+			if len(c.ec2Client.Subnets(c.vpcID)) != len(tc.azs) {
+				t.Fatalf("expected %d subnets in vpc, got %d", len(tc.azs), len(c.ec2Client.Subnets(c.vpcID)))
+			}
+
+			var eniConfigs eniv1alpha1.ENIConfigList
+			err = c.wcClient.List(context.Background(), &eniConfigs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(eniConfigs.Items) != len(tc.azs) {
+				t.Fatalf("expected %d ENIConfigs, got %d", len(tc.azs), len(eniConfigs.Items))
+			}
+
+			for _, s := range subnets {
+				if !s.Active {
+					t.Fatalf("expected subnet %s to be active", s.SubnetID)
+				}
+				if c.ec2Client.RouteTableOf(s.SubnetID) != c.routeTableIDs[s.AZ] {
+					t.Fatalf("expected subnet %s to be associated with route table %s, got %s", s.SubnetID, c.routeTableIDs[s.AZ], c.ec2Client.RouteTableOf(s.SubnetID))
+				}
+			}
+		})
+	}
+}
+
+func Test_Reconcile_Idempotent(t *testing.T) {
+	testCases := []struct {
+		name string
+		azs  []string
+		// recoverFrom is an operation failing during the first reconciliation
+		recoverFrom string
+	}{
+		{
+			name: "case 0: second reconciliation does not change anything",
+			azs:  []string{"eu-west-1a", "eu-west-1b", "eu-west-1c"},
+		},
+		{
+			name:        "case 1: reconciliation after failed subnet creation completes",
+			azs:         []string{"eu-west-1a", "eu-west-1b"},
+			recoverFrom: "CreateSubnet",
+		},
+		{
+			name:        "case 2: reconciliation after failed route table association completes",
+			azs:         []string{"eu-west-1a", "eu-west-1b"},
+			recoverFrom: "AssociateRouteTable",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, tc.azs)
+
+			if tc.recoverFrom != "" {
+				c.ec2Client.Fail(tc.recoverFrom, awserr.New("InternalError", "internal error", nil))
+				_, err := c.service(t).Reconcile()
+				if err == nil {
+					t.Fatalf("expected %s failure", tc.recoverFrom)
+				}
+				c.ec2Client.Fail(tc.recoverFrom, nil)
+			}
+
+			first, err := c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			calls := map[string]int{}
+			for _, op := range mutatingOperations {
+				calls[op] = c.ec2Client.Calls(op)
+			}
+
+			second, err := c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, op := range mutatingOperations {
+				if c.ec2Client.Calls(op) != calls[op] {
+					t.Fatalf("expected no %s calls in second reconciliation, got %d", op, c.ec2Client.Calls(op)-calls[op])
+				}
+			}
+			if len(first) != len(second) {
+				t.Fatalf("expected %d cni subnets, got %d", len(first), len(second))
+			}
+			for i := range first {
+				if first[i].SubnetID != second[i].SubnetID {
+					t.Fatalf("expected subnet %s, got %s", first[i].SubnetID, second[i].SubnetID)
+				}
+			}
+			if len(c.ec2Client.Subnets(c.vpcID)) != len(tc.azs) {
+				t.Fatalf("expected %d subnets in vpc, got %d", len(tc.azs), len(c.ec2Client.Subnets(c.vpcID)))
+			}
+		})
+	}
+}
+
+func Test_Delete(t *testing.T) {
+	testCases := []struct {
+		name string
+		// setup changes the EC2 backend after the cluster was reconciled
+		setup           func(c *testCluster, subnets []cni.CNISubnet)
+		expectError     bool
+		expectCIDRInUse bool
+	}{
+		{
+			name: "case 0: delete subnets and disassociate cidr",
+		},
+		{
+			name: "case 1: delete attached and detached network interfaces",
+			setup: func(c *testCluster, subnets []cni.CNISubnet) {
+				for _, s := range subnets {
+					c.ec2Client.AddNetworkInterface(s.SubnetID, true)
+					c.ec2Client.AddNetworkInterface(s.SubnetID, false)
+				}
+			},
+		},
+		{
+			name: "case 2: vpc is already deleted",
+			setup: func(c *testCluster, subnets []cni.CNISubnet) {
+				c.ec2Client.DeleteVPC(c.vpcID)
+			},
+		},
+		{
+			name: "case 3: subnet deletion fails",
+			setup: func(c *testCluster, subnets []cni.CNISubnet) {
+				c.ec2Client.Fail("DeleteSubnet", awserr.New("InternalError", "internal error", nil))
+			},
+			expectError: true,
+		},
+		{
+			name: "case 4: foreign subnet in cni cidr blocks disassociation",
+			setup: func(c *testCluster, subnets []cni.CNISubnet) {
+				c.ec2Client.AddSubnet(c.vpcID, "eu-west-1a", "100.64.255.0/24", map[string]string{"Name": "foreign"})
+			},
+			expectError:     true,
+			expectCIDRInUse: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+			subnets, err := c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(c, subnets)
+			}
+
+			err = c.service(t).Delete()
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !c.cidrAssociated() {
+					t.Fatal("expected cidr to stay associated while subnets exist")
+				}
+				if errors.Is(err, cni.ErrCIDRInUse) != tc.expectCIDRInUse {
+					t.Fatalf("expected cidr in use error %t, got %v", tc.expectCIDRInUse, err)
+				}
+				if tc.expectCIDRInUse && cni.Reason(err) != key.CIDRInUseReason {
+					t.Fatalf("expected reason %s, got %s", key.CIDRInUseReason, cni.Reason(err))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range subnets {
+				if len(c.ec2Client.NetworkInterfaces(s.SubnetID)) != 0 {
+					t.Fatalf("expected network interfaces of subnet %s to be deleted", s.SubnetID)
+				}
+			}
+			if len(c.ec2Client.Subnets(c.vpcID)) != 0 {
+				t.Fatalf("expected all subnets to be deleted, got %d", len(c.ec2Client.Subnets(c.vpcID)))
+			}
+			if c.cidrAssociated() {
+				t.Fatalf("expected cidr %s to be disassociated", cniCIDR)
+			}
+
+			var eniConfigs eniv1alpha1.ENIConfigList
+			err = c.wcClient.List(context.Background(), &eniConfigs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(eniConfigs.Items) != 0 {
+				t.Fatalf("expected ENIConfigs to be deleted, got %d", len(eniConfigs.Items))
+			}
+
+			// deleting again is a no-op
+			err = c.service(t).Delete()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_New(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      func(config *cni.CNIConfig)
+		expectError bool
+	}{
+		{
+			name:   "case 0: valid config",
+			config: func(config *cni.CNIConfig) {},
+		},
+		{
+			name: "case 1: nil AWSSession and EC2Client",
+			config: func(config *cni.CNIConfig) {
+				config.EC2Client = nil
+			},
+			expectError: true,
+		},
+		{
+			name: "case 2: empty ClusterName",
+			config: func(config *cni.CNIConfig) {
+				config.ClusterName = ""
+			},
+			expectError: true,
+		},
+		{
+			name: "case 3: invalid CNICIDR",
+			config: func(config *cni.CNIConfig) {
+				config.CNICIDR = "100.64.0.0"
+			},
+			expectError: true,
+		},
+		{
+			name: "case 4: subnet mask size larger than CNICIDR",
+			config: func(config *cni.CNIConfig) {
+				config.SubnetMaskSize = 12
+			},
+			expectError: true,
+		},
+		{
+			name: "case 5: subnet mask size larger than AdditionalCNICIDR",
+			config: func(config *cni.CNIConfig) {
+				config.SubnetMaskSize = 18
+				config.AdditionalCNICIDRs = []string{"100.65.0.0/20"}
+			},
+			expectError: true,
+		},
+		{
+			name: "case 6: existing subnet with neither ID nor tags",
+			config: func(config *cni.CNIConfig) {
+				config.ExistingSubnets = []cni.ExistingSubnet{{AZ: "eu-west-1a"}}
+			},
+			expectError: true,
+		},
+		{
+			name: "case 7: two existing subnets for one AZ",
+			config: func(config *cni.CNIConfig) {
+				config.ExistingSubnets = []cni.ExistingSubnet{
+					{AZ: "eu-west-1a", ID: "subnet-1"},
+					{AZ: "eu-west-1a", ID: "subnet-2"},
+				}
+			},
+			expectError: true,
+		},
+		{
+			name: "case 8: empty VPCAzList",
+			config: func(config *cni.CNIConfig) {
+				config.VPCAzList = nil
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := cni.CNIConfig{
+				ClusterName:        clusterName,
+				CNICIDR:            cniCIDR,
+				CNISecurityGroupID: "sg-0123456789abcdef0",
+				EC2Client:          fake.NewEC2(),
+				EventObject:        &capa.AWSCluster{},
+				Log:                ctrllog.NullLogger{},
+				VPCAzList:          []string{"eu-west-1a"},
+				VPCID:              "vpc-1",
+			}
+			tc.config(&config)
+
+			_, err := cni.New(config)
+			if tc.expectError && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tc.expectError && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_Reconcile_AdditionalCIDRs(t *testing.T) {
+	azs := []string{"eu-west-1a", "eu-west-1b"}
+	additionalCIDR := "100.65.0.0/16"
+	c := newTestCluster(t, azs)
+
+	_, err := c.service(t).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnets, err := c.service(t, func(config *cni.CNIConfig) {
+		config.AdditionalCNICIDRs = []string{additionalCIDR}
+	}).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subnets) != 2*len(azs) {
+		t.Fatalf("expected %d cni subnets, got %d", 2*len(azs), len(subnets))
+	}
+	_, additionalNetwork, _ := net.ParseCIDR(additionalCIDR)
+	active := map[string]string{}
+	for _, s := range subnets {
+		ip, _, err := net.ParseCIDR(s.CIDRBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Active != additionalNetwork.Contains(ip) {
+			t.Fatalf("expected only subnets of the newest cidr to be active, subnet %s with range %s has active %t", s.SubnetID, s.CIDRBlock, s.Active)
+		}
+		if s.Active {
+			active[s.AZ] = s.SubnetID
+		}
+	}
+
+	vpc := c.ec2Client.VPC(c.vpcID)
+	if len(vpc.CidrBlockAssociationSet) != 3 {
+		t.Fatalf("expected 3 cidr blocks associated with vpc, got %d", len(vpc.CidrBlockAssociationSet))
+	}
+
+	eniConfigs := c.eniConfigs(t)
+	for _, az := range azs {
+		if eniConfigs[az].Spec.Subnet != active[az] {
+			t.Fatalf("expected ENIConfig %s to use subnet %s, got %s", az, active[az], eniConfigs[az].Spec.Subnet)
+		}
+	}
+}
+
+func Test_Reconcile_SubnetMaskSize(t *testing.T) {
+	testCases := []struct {
+		name           string
+		azs            []string
+		subnetMaskSize int
+		expectedSize   int
+	}{
+		{
+			name:         "case 0: cidr is split evenly between AZs",
+			azs:          []string{"eu-west-1a", "eu-west-1b", "eu-west-1c"},
+			expectedSize: 18,
+		},
+		{
+			name:           "case 1: subnets have the configured size",
+			azs:            []string{"eu-west-1a", "eu-west-1b", "eu-west-1c"},
+			subnetMaskSize: 20,
+			expectedSize:   20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, tc.azs)
+
+			subnets, err := c.service(t, func(config *cni.CNIConfig) {
+				config.SubnetMaskSize = tc.subnetMaskSize
+			}).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range subnets {
+				_, n, err := net.ParseCIDR(s.CIDRBlock)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ones, _ := n.Mask.Size(); ones != tc.expectedSize {
+					t.Fatalf("expected subnet %s to have size /%d, got /%d", s.SubnetID, tc.expectedSize, ones)
+				}
+			}
+		})
+	}
+}
+
+func Test_Reconcile_RouteTableDrift(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a"})
+
+	subnets, err := c.service(t).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expected route table of the AZ changed, e.g. it was recreated
+	routeTableID := c.ec2Client.AddRouteTable(c.vpcID)
+	c.routeTableIDs["eu-west-1a"] = routeTableID
+
+	_, err = c.service(t).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ec2Client.Calls("ReplaceRouteTableAssociation") != 1 {
+		t.Fatalf("expected 1 ReplaceRouteTableAssociation call, got %d", c.ec2Client.Calls("ReplaceRouteTableAssociation"))
+	}
+	if c.ec2Client.RouteTableOf(subnets[0].SubnetID) != routeTableID {
+		t.Fatalf("expected subnet %s to be associated with route table %s, got %s", subnets[0].SubnetID, routeTableID, c.ec2Client.RouteTableOf(subnets[0].SubnetID))
+	}
+}
+
+func Test_Reconcile_ENIConfig(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+	_, err := c.service(t).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changed config is applied to the existing ENIConfigs
+	subnets, err := c.service(t, func(config *cni.CNIConfig) {
+		config.AdditionalSecurityGroupIDs = []string{"sg-additional"}
+		config.ENIConfigAnnotations = map[string]string{"example.com/annotation": "value"}
+		config.ENIConfigLabels = map[string]string{"example.com/label": "value"}
+	}).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eniConfigs := c.eniConfigs(t)
+	for _, s := range subnets {
+		eniConfig, ok := eniConfigs[s.AZ]
+		if !ok {
+			t.Fatalf("expected ENIConfig %s", s.AZ)
+		}
+		if eniConfig.Spec.Subnet != s.SubnetID {
+			t.Fatalf("expected ENIConfig %s to use subnet %s, got %s", s.AZ, s.SubnetID, eniConfig.Spec.Subnet)
+		}
+		expectedSecurityGroups := []string{"sg-0123456789abcdef0", "sg-additional"}
+		if !reflect.DeepEqual(eniConfig.Spec.SecurityGroups, expectedSecurityGroups) {
+			t.Fatalf("expected ENIConfig %s to use security groups %v, got %v", s.AZ, expectedSecurityGroups, eniConfig.Spec.SecurityGroups)
+		}
+		if eniConfig.Labels["example.com/label"] != "value" || eniConfig.Labels[key.ManagedByLabel] != key.ManagedByLabelValue {
+			t.Fatalf("expected ENIConfig %s to have configured and managed-by labels, got %v", s.AZ, eniConfig.Labels)
+		}
+		if eniConfig.Annotations["example.com/annotation"] != "value" {
+			t.Fatalf("expected ENIConfig %s to have configured annotation, got %v", s.AZ, eniConfig.Annotations)
+		}
+	}
+}
+
+func Test_Reconcile_AWSSession(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+	server := httptest.NewServer(c.ec2Client)
+	defer server.Close()
+
+	awsSession, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("AKIATEST", "secret", ""),
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSession := func(config *cni.CNIConfig) {
+		config.AWSSession = awsSession
+		config.EC2Client = nil
+	}
+
+	subnets, err := c.service(t, withSession).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("expected 2 cni subnets, got %d", len(subnets))
+	}
+	for _, s := range subnets {
+		if c.ec2Client.RouteTableOf(s.SubnetID) != c.routeTableIDs[s.AZ] {
+			t.Fatalf("expected subnet %s to be associated with route table %s, got %s", s.SubnetID, c.routeTableIDs[s.AZ], c.ec2Client.RouteTableOf(s.SubnetID))
+		}
+	}
+	if !c.cidrAssociated() {
+		t.Fatalf("expected cidr %s to be associated with vpc", cniCIDR)
+	}
+	if !reflect.DeepEqual(c.ec2Client.AccessKeyIDs(), []string{"AKIATEST"}) {
+		t.Fatalf("expected requests signed with AKIATEST, got %v", c.ec2Client.AccessKeyIDs())
+	}
+
+	err = c.service(t, withSession).Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ec2Client.Subnets(c.vpcID)) != 0 {
+		t.Fatalf("expected all subnets to be deleted, got %d", len(c.ec2Client.Subnets(c.vpcID)))
+	}
+	if c.cidrAssociated() {
+		t.Fatalf("expected cidr %s to be disassociated", cniCIDR)
+	}
+}
+
+func Test_Reconcile_RemovedAZ(t *testing.T) {
+	testCases := []struct {
+		name string
+		// attached and detached are the network interfaces in the subnet of the removed AZ
+		attached int
+		detached int
+	}{
+		{
+			name: "case 0: subnet of removed AZ without network interfaces is deleted",
+		},
+		{
+			name:     "case 1: subnet of removed AZ with detached network interfaces is deleted",
+			detached: 2,
+		},
+		{
+			name:     "case 2: subnet of removed AZ is kept until its network interfaces are detached",
+			attached: 1,
+			detached: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+			subnets, err := c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var removed cni.CNISubnet
+			for _, s := range subnets {
+				if s.AZ == "eu-west-1b" {
+					removed = s
+				}
+			}
+			for i := 0; i < tc.attached; i++ {
+				c.ec2Client.AddNetworkInterface(removed.SubnetID, true)
+			}
+			for i := 0; i < tc.detached; i++ {
+				c.ec2Client.AddNetworkInterface(removed.SubnetID, false)
+			}
+
+			// eu-west-1b is removed from the cluster
+			c.azs = []string{"eu-west-1a"}
+			subnets, err = c.service(t).Reconcile()
+			if err != nil {
+				t.Fatalf("expected draining subnets not to fail the reconciliation, got %s", err)
+			}
+
+			if _, ok := c.eniConfigs(t)["eu-west-1b"]; ok {
+				t.Fatal("expected ENIConfig of removed AZ to be deleted")
+			}
+			if _, ok := c.eniConfigs(t)["eu-west-1a"]; !ok {
+				t.Fatal("expected ENIConfig of remaining AZ to be kept")
+			}
+
+			var draining []cni.CNISubnet
+			for _, s := range subnets {
+				if s.Draining {
+					draining = append(draining, s)
+				} else if !s.Active || s.AZ != "eu-west-1a" {
+					t.Fatalf("expected only the active subnet of the remaining AZ, got %s in %s", s.SubnetID, s.AZ)
+				}
+			}
+
+			if tc.attached == 0 {
+				if len(draining) != 0 {
+					t.Fatalf("expected no draining subnets, got %d", len(draining))
+				}
+				if len(c.ec2Client.Subnets(c.vpcID)) != 1 {
+					t.Fatalf("expected subnet of removed AZ to be deleted, got %d subnets", len(c.ec2Client.Subnets(c.vpcID)))
+				}
+				if len(c.ec2Client.NetworkInterfaces(removed.SubnetID)) != 0 {
+					t.Fatal("expected detached network interfaces to be deleted")
+				}
+				return
+			}
+
+			if len(draining) != 1 || draining[0].SubnetID != removed.SubnetID || draining[0].Active {
+				t.Fatalf("expected subnet %s to be draining, got %v", removed.SubnetID, draining)
+			}
+			if len(c.ec2Client.Subnets(c.vpcID)) != 2 {
+				t.Fatalf("expected subnet of removed AZ to be kept while draining, got %d subnets", len(c.ec2Client.Subnets(c.vpcID)))
+			}
+			if c.ec2Client.Calls("DetachNetworkInterface") != 0 {
+				t.Fatal("expected attached network interfaces not to be force detached")
+			}
+
+			// nodes of the removed AZ are gone
+			for _, eni := range c.ec2Client.NetworkInterfaces(removed.SubnetID) {
+				if eni.Attachment != nil {
+					_, err := c.ec2Client.DetachNetworkInterface(&ec2.DetachNetworkInterfaceInput{AttachmentId: eni.Attachment.AttachmentId})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			subnets, err = c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range subnets {
+				if s.Draining {
+					t.Fatalf("expected no draining subnets, got %s", s.SubnetID)
+				}
+			}
+			if len(c.ec2Client.Subnets(c.vpcID)) != 1 {
+				t.Fatalf("expected subnet of removed AZ to be deleted once drained, got %d subnets", len(c.ec2Client.Subnets(c.vpcID)))
+			}
+		})
+	}
+}
+
+func Test_Reconcile_PruneENIConfigs(t *testing.T) {
+	docs := map[string]string{"giantswarm.io/docs": "https://godoc.org/github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1#ENIConfig"}
+
+	testCases := []struct {
+		name        string
+		eniConfig   metav1.ObjectMeta
+		expectKept  bool
+		expectAdopt bool
+	}{
+		{
+			name:      "case 0: managed ENIConfig of removed AZ is deleted",
+			eniConfig: metav1.ObjectMeta{Name: "eu-west-1c", Labels: map[string]string{key.ManagedByLabel: key.ManagedByLabelValue}},
+		},
+		{
+			name:      "case 1: unlabeled ENIConfig created by the operator for removed AZ is deleted",
+			eniConfig: metav1.ObjectMeta{Name: "eu-west-1c", Annotations: docs},
+		},
+		{
+			name:        "case 2: unlabeled ENIConfig created by the operator for current AZ is adopted",
+			eniConfig:   metav1.ObjectMeta{Name: "eu-west-1b", Annotations: docs},
+			expectKept:  true,
+			expectAdopt: true,
+		},
+		{
+			name:       "case 3: unlabeled ENIConfig without docs annotation is kept",
+			eniConfig:  metav1.ObjectMeta{Name: "eu-west-1c"},
+			expectKept: true,
+		},
+		{
+			name:       "case 4: ENIConfig managed by someone else is kept",
+			eniConfig:  metav1.ObjectMeta{Name: "eu-west-1c", Annotations: docs, Labels: map[string]string{key.ManagedByLabel: "other"}},
+			expectKept: true,
+		},
+		{
+			name:       "case 5: unlabeled ENIConfig not named after an AZ of the cluster region is kept",
+			eniConfig:  metav1.ObjectMeta{Name: "custom", Annotations: docs},
+			expectKept: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+			eniConfig := &eniv1alpha1.ENIConfig{ObjectMeta: tc.eniConfig}
+			eniConfig.Namespace = "default"
+			err := c.wcClient.Create(context.Background(), eniConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.service(t).Reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			eniConfigs := c.eniConfigs(t)
+			kept, ok := eniConfigs[tc.eniConfig.Name]
+			if ok != tc.expectKept {
+				t.Fatalf("expected ENIConfig %s to be kept %t, got %t", tc.eniConfig.Name, tc.expectKept, ok)
+			}
+			if tc.expectAdopt && kept.Labels[key.ManagedByLabel] != key.ManagedByLabelValue {
+				t.Fatalf("expected ENIConfig %s to be labeled as managed, got %v", tc.eniConfig.Name, kept.Labels)
+			}
+			for _, az := range c.azs {
+				if _, ok := eniConfigs[az]; !ok {
+					t.Fatalf("expected ENIConfig %s", az)
+				}
+			}
+
+			// deleting the cluster removes the adopted ENIConfigs and keeps the others
+			err = c.service(t).Delete()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ok = c.eniConfigs(t)[tc.eniConfig.Name]
+			expectKept := tc.expectKept && !tc.expectAdopt
+			if ok != expectKept {
+				t.Fatalf("expected ENIConfig %s to be kept on deletion %t, got %t", tc.eniConfig.Name, expectKept, ok)
+			}
+		})
+	}
+}
+
+func Test_Reconcile_ExistingSubnets(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+	byID := c.ec2Client.AddSubnet(c.vpcID, "eu-west-1a", "10.0.128.0/20", map[string]string{"Name": "pods-a"})
+	byTags := c.ec2Client.AddSubnet(c.vpcID, "eu-west-1b", "10.0.144.0/20", map[string]string{"Name": "pods-b", "example.com/role": "pods"})
+	existingSubnets := func(config *cni.CNIConfig) {
+		config.ExistingSubnets = []cni.ExistingSubnet{
+			{AZ: "eu-west-1a", ID: byID},
+			{AZ: "eu-west-1b", Tags: map[string]string{"example.com/role": "pods"}},
+		}
+	}
+
+	subnets, err := c.service(t, existingSubnets).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"eu-west-1a": byID, "eu-west-1b": byTags}
+	if len(subnets) != len(expected) {
+		t.Fatalf("expected %d subnets, got %d", len(expected), len(subnets))
+	}
+	eniConfigs := c.eniConfigs(t)
+	for az, subnetID := range expected {
+		if eniConfigs[az].Spec.Subnet != subnetID {
+			t.Fatalf("expected ENIConfig %s to use subnet %s, got %s", az, subnetID, eniConfigs[az].Spec.Subnet)
+		}
+	}
+
+	err = c.service(t, existingSubnets).Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range mutatingOperations {
+		if c.ec2Client.Calls(op) != 0 {
+			t.Fatalf("expected no %s calls for existing subnets, got %d", op, c.ec2Client.Calls(op))
+		}
+	}
+	if len(c.ec2Client.Subnets(c.vpcID)) != len(expected) {
+		t.Fatalf("expected existing subnets to be kept, got %d subnets", len(c.ec2Client.Subnets(c.vpcID)))
+	}
+	if c.cidrAssociated() {
+		t.Fatalf("expected cidr %s not to be associated", cniCIDR)
+	}
+	if len(c.eniConfigs(t)) != 0 {
+		t.Fatalf("expected ENIConfigs to be deleted, got %d", len(c.eniConfigs(t)))
+	}
+}
+
+func Test_Reconcile_OccupiedSubnetRange(t *testing.T) {
+	testCases := []struct {
+		name string
+		// az and cidr of the subnet which occupies the CNI subnet range of eu-west-1a, 100.64.0.0/17
+		az             string
+		cidr           string
+		tags           map[string]string
+		expectAdopted  bool
+		expectedReason string
+	}{
+		{
+			name:          "case 0: subnet left behind without cluster tag is adopted",
+			az:            "eu-west-1a",
+			cidr:          "100.64.0.0/17",
+			tags:          map[string]string{"Name": "test-subnet-cni-previous", key.AWSCniOperatorOwnedTag: "owned"},
+			expectAdopted: true,
+		},
+		{
+			name:          "case 1: subnet left behind with cluster tag is adopted",
+			az:            "eu-west-1a",
+			cidr:          "100.64.0.0/17",
+			tags:          map[string]string{"Name": "test-subnet-cni-previous", key.AWSCniOperatorOwnedTag: "owned", "sigs.k8s.io/cluster-api-provider-aws/cluster/test": "owned"},
+			expectAdopted: true,
+		},
+		{
+			name:           "case 2: overlapping foreign subnet is a conflict",
+			az:             "eu-west-1a",
+			cidr:           "100.64.0.0/24",
+			tags:           map[string]string{"Name": "foreign"},
+			expectedReason: key.SubnetConflictReason,
+		},
+		{
+			name:           "case 3: foreign subnet containing the range is a conflict",
+			az:             "eu-west-1a",
+			cidr:           "100.64.0.0/16",
+			tags:           map[string]string{"Name": "foreign"},
+			expectedReason: key.SubnetConflictReason,
+		},
+		{
+			name:           "case 4: CNI subnet of another cluster with the same prefix is a conflict",
+			az:             "eu-west-1a",
+			cidr:           "100.64.0.0/17",
+			tags:           map[string]string{"Name": "test-subnet-cni-previous", key.AWSCniOperatorOwnedTag: "owned", "sigs.k8s.io/cluster-api-provider-aws/cluster/other": "owned"},
+			expectedReason: key.SubnetConflictReason,
+		},
+		{
+			name:           "case 5: CNI subnet in another AZ is a conflict",
+			az:             "eu-west-1b",
+			cidr:           "100.64.0.0/17",
+			tags:           map[string]string{"Name": "test-subnet-cni-previous", key.AWSCniOperatorOwnedTag: "owned"},
+			expectedReason: key.SubnetConflictReason,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+			occupyingID := c.ec2Client.AddSubnet(c.vpcID, tc.az, tc.cidr, tc.tags)
+
+			subnets, err := c.service(t).Reconcile()
+			if tc.expectedReason != "" {
+				if cni.Reason(err) != tc.expectedReason {
+					t.Fatalf("expected reason %s, got %s: %v", tc.expectedReason, cni.Reason(err), err)
+				}
+				if c.ec2Client.Calls("CreateSubnet") != 0 || c.ec2Client.Calls("CreateTags") != 0 {
+					t.Fatal("expected no subnet to be created or tagged on conflict")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.ec2Client.Calls("CreateSubnet") != 1 {
+				t.Fatalf("expected only the subnet of eu-west-1b to be created, got %d", c.ec2Client.Calls("CreateSubnet"))
+			}
+			var adopted *cni.CNISubnet
+			for i := range subnets {
+				if subnets[i].AZ == "eu-west-1a" {
+					adopted = &subnets[i]
+				}
+			}
+			if adopted == nil || adopted.SubnetID != occupyingID {
+				t.Fatalf("expected subnet %s to be adopted, got %v", occupyingID, subnets)
+			}
+			if c.eniConfigs(t)["eu-west-1a"].Spec.Subnet != occupyingID {
+				t.Fatalf("expected ENIConfig to use adopted subnet %s", occupyingID)
+			}
+
+			tags := map[string]string{}
+			for _, subnet := range c.ec2Client.Subnets(c.vpcID) {
+				if aws.StringValue(subnet.SubnetId) != occupyingID {
+					continue
+				}
+				for _, tag := range subnet.Tags {
+					tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+			}
+			if tags["Name"] != "test-subnet-cni-eu-west-1a" || tags["sigs.k8s.io/cluster-api-provider-aws/cluster/test"] != "owned" {
+				t.Fatalf("expected adopted subnet to be renamed and tagged with the cluster tag, got %v", tags)
+			}
+		})
+	}
+}
+
+func Test_Reconcile_SubnetTags(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+	first := c.service(t, func(config *cni.CNIConfig) {
+		config.ClusterTags = map[string]string{"example.com/owner": "team-a"}
+		config.AdditionalTags = map[string]string{"example.com/cost-center": "1", "example.com/env": "prod"}
+	})
+	subnets, err := first.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tags added by someone else
+	var subnetIDs []*string
+	for _, s := range subnets {
+		subnetIDs = append(subnetIDs, aws.String(s.SubnetID))
+	}
+	_, err = c.ec2Client.CreateTags(&ec2.CreateTagsInput{
+		Resources: subnetIDs,
+		Tags:      []*ec2.Tag{{Key: aws.String("example.com/foreign"), Value: aws.String("value")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cost center changes and the env tag is removed
+	_, err = c.service(t, func(config *cni.CNIConfig) {
+		config.ClusterTags = map[string]string{"example.com/owner": "team-a"}
+		config.AdditionalTags = map[string]string{"example.com/cost-center": "2"}
+		config.LastAppliedTags = first.AdditionalSubnetTags()
+	}).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"example.com/cost-center": "2",
+		"example.com/foreign":     "value",
+		"example.com/owner":       "team-a",
+	}
+	for _, subnet := range c.ec2Client.Subnets(c.vpcID) {
+		tags := map[string]string{}
+		for _, tag := range subnet.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		for k, v := range expected {
+			if tags[k] != v {
+				t.Fatalf("expected subnet %s to have tag %s=%s, got %v", aws.StringValue(subnet.SubnetId), k, v, tags)
+			}
+		}
+		if _, ok := tags["example.com/env"]; ok {
+			t.Fatalf("expected removed tag example.com/env to be deleted from subnet %s", aws.StringValue(subnet.SubnetId))
+		}
+		if tags[key.AWSCniOperatorOwnedTag] != "owned" {
+			t.Fatalf("expected subnet %s to keep the operator tag, got %v", aws.StringValue(subnet.SubnetId), tags)
+		}
+	}
+}
+
+func Test_Reconcile_LegacySubnets(t *testing.T) {
+	c := newTestCluster(t, []string{"eu-west-1a", "eu-west-1b"})
+
+	// subnets created before the cluster ownership tag was introduced only carry the name and operator tag
+	legacy := c.ec2Client.AddSubnet(c.vpcID, "eu-west-1a", "100.64.0.0/17", map[string]string{"Name": "test-subnet-cni-eu-west-1a", key.AWSCniOperatorOwnedTag: "owned"})
+	legacyRemovedAZ := c.ec2Client.AddSubnet(c.vpcID, "eu-west-1c", "10.0.210.0/24", map[string]string{"Name": "test-subnet-cni-eu-west-1c", key.AWSCniOperatorOwnedTag: "owned"})
+	// cluster test-2 shares the VPC and the name prefix
+	otherCluster := c.ec2Client.AddSubnet(c.vpcID, "eu-west-1c", "10.0.220.0/24", map[string]string{
+		"Name":                     "test-subnet-cni-eu-west-1c",
+		key.AWSCniOperatorOwnedTag: "owned",
+		"sigs.k8s.io/cluster-api-provider-aws/cluster/test-2": "owned",
+	})
+
+	subnets, err := c.service(t).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ec2Client.Calls("CreateSubnet") != 1 {
+		t.Fatalf("expected only the subnet of eu-west-1b to be created, got %d", c.ec2Client.Calls("CreateSubnet"))
+	}
+	found := false
+	for _, s := range subnets {
+		if s.SubnetID == legacy {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected legacy subnet %s to be used, got %v", legacy, subnets)
+	}
+
+	subnetsByID := func() map[string]*ec2.Subnet {
+		byID := map[string]*ec2.Subnet{}
+		for _, s := range c.ec2Client.Subnets(c.vpcID) {
+			byID[aws.StringValue(s.SubnetId)] = s
+		}
+		return byID
+	}
+	vpcSubnets := subnetsByID()
+	if _, ok := vpcSubnets[legacyRemovedAZ]; ok {
+		t.Fatalf("expected legacy subnet %s of removed AZ to be deleted", legacyRemovedAZ)
+	}
+	if _, ok := vpcSubnets[otherCluster]; !ok {
+		t.Fatalf("expected subnet %s of other cluster to be kept", otherCluster)
+	}
+	tagged := false
+	for _, tag := range vpcSubnets[legacy].Tags {
+		if aws.StringValue(tag.Key) == "sigs.k8s.io/cluster-api-provider-aws/cluster/test" && aws.StringValue(tag.Value) == "owned" {
+			tagged = true
+		}
+	}
+	if !tagged {
+		t.Fatalf("expected legacy subnet %s to be tagged with the cluster tag", legacy)
+	}
+
+	err = c.service(t).Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vpcSubnets = subnetsByID()
+	if _, ok := vpcSubnets[legacy]; ok {
+		t.Fatalf("expected legacy subnet %s to be deleted", legacy)
+	}
+	if len(vpcSubnets) != 1 {
+		t.Fatalf("expected only the subnet %s of other cluster to be kept, got %d subnets", otherCluster, len(vpcSubnets))
+	}
+	if _, ok := vpcSubnets[otherCluster]; !ok {
+		t.Fatalf("expected subnet %s of other cluster to be kept", otherCluster)
+	}
+}
@@ -1,21 +1,130 @@
 package cni
 
 import (
-	"strings"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+var (
+	// ErrWorkloadAPINotReady is returned when the wc k8s api can not be reached yet
+	ErrWorkloadAPINotReady = errors.New("WC k8s api is not ready yet")
+	// ErrENIConfigNotRegistered is returned when aws-cni did not register the ENIConfig CRD in the wc yet
+	ErrENIConfigNotRegistered = errors.New("WC k8s api does not have ENIConfig CRD yet")
+	// ErrCIDRInUse is returned when the CNI CIDR block cannot be disassociated because subnets of others are in it
+	ErrCIDRInUse = errors.New("CNI CIDR block is still used by subnets")
 )
 
-// IsApiNotReadyYet will assert possible errors that can be caused wc k8s api not ready yet
-func IsApiNotReadyYet(err error) bool {
-	if err != nil && (strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "no such host")) {
+// causeError is one of the sentinel errors above carrying the underlying error which caused it
+type causeError struct {
+	kind  error
+	cause error
+}
+
+func (e *causeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.cause)
+}
+
+func (e *causeError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *causeError) Unwrap() error {
+	return e.cause
+}
+
+func withCause(kind error, cause error) error {
+	return &causeError{kind: kind, cause: cause}
+}
+
+// reconcileError annotates an error with the condition reason of the reconcile step that failed
+type reconcileError struct {
+	reason string
+	err    error
+}
+
+func (e *reconcileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reconcileError) Unwrap() error {
+	return e.err
+}
+
+// withReason annotates the error with the reason unless it already carries a more specific one
+func withReason(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if Reason(err) != "" {
+		return err
+	}
+	return &reconcileError{reason: reason, err: err}
+}
+
+// Reason returns the condition reason of the reconcile step which caused the error
+// or empty string if the error does not carry any
+func Reason(err error) string {
+	var r *reconcileError
+	if errors.As(err, &r) {
+		return r.reason
+	}
+	return ""
+}
+
+// IsAPINotReady will assert errors caused by the wc k8s api not being reachable yet
+func IsAPINotReady(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 		return true
 	}
-	return false
+	// wc api DNS record is not created yet
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	// wc api load balancer is up but the api server is not listening yet
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// url.Error implements net.Error for any request failure, so only timeouts are checked,
+	// permanent failures like certificate errors must not be reported as api not being ready
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return k8serrors.IsServiceUnavailable(err)
 }
 
-//IsENIConfigNotRegistered will assert and error when aws-cni did not registered ENIConfigs CRD
+// IsENIConfigNotRegistered will assert errors caused by aws-cni not having registered the ENIConfig CRD yet
 func IsENIConfigNotRegistered(err error) bool {
-	if err != nil && (strings.Contains(err.Error(), "no matches for kind")) {
-		return true
+	for ; err != nil; err = errors.Unwrap(err) {
+		if meta.IsNoMatchError(err) {
+			return true
+		}
 	}
 	return false
 }
+
+// IsVPCNotFound will assert AWS error when the VPC does not exist anymore
+func IsVPCNotFound(err error) bool {
+	return hasAWSErrorCode(err, "InvalidVpcID.NotFound")
+}
+
+// IsCidrAssociationNotFound will assert AWS error when the VPC CIDR block association does not exist anymore
+func IsCidrAssociationNotFound(err error) bool {
+	return hasAWSErrorCode(err, "InvalidVpcCidrBlockAssociationID.NotFound")
+}
+
+func hasAWSErrorCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
@@ -0,0 +1,88 @@
+package cni
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_IsAPINotReady(t *testing.T) {
+	requestError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://api.example.com", Err: err}
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "case 0: nil error",
+			err:      nil,
+			expected: false,
+		},
+		{
+			name:     "case 1: connection closed",
+			err:      requestError(io.EOF),
+			expected: true,
+		},
+		{
+			name:     "case 2: api DNS record does not exist yet",
+			err:      requestError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "api.example.com", IsNotFound: true}}),
+			expected: true,
+		},
+		{
+			name:     "case 3: connection refused",
+			err:      requestError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			expected: true,
+		},
+		{
+			name:     "case 4: timeout",
+			err:      requestError(&net.OpError{Op: "dial", Err: timeoutError{}}),
+			expected: true,
+		},
+		{
+			name:     "case 5: api server unavailable",
+			err:      k8serrors.NewServiceUnavailable("starting"),
+			expected: true,
+		},
+		{
+			name:     "case 6: unknown certificate authority",
+			err:      requestError(x509.UnknownAuthorityError{}),
+			expected: false,
+		},
+		{
+			name:     "case 7: forbidden",
+			err:      k8serrors.NewForbidden(schema.GroupResource{Resource: "eniconfigs"}, "eu-west-1a", errors.New("denied")),
+			expected: false,
+		},
+		{
+			name:     "case 8: api not ready wrapped with reason",
+			err:      withReason("WaitingForWorkloadAPI", withCause(ErrWorkloadAPINotReady, requestError(io.EOF))),
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := IsAPINotReady(tc.err)
+			if result != tc.expected {
+				t.Fatalf("expected %t, got %t for %v", tc.expected, result, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,751 @@
+// Package fake provides a stateful in-memory EC2 backend implementing cni.EC2API,
+// so the CNI service can be exercised without AWS.
+package fake
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
+)
+
+var _ cni.EC2API = &EC2{}
+
+// EC2 keeps VPCs, subnets, network interfaces and route tables in memory
+type EC2 struct {
+	mu sync.Mutex
+
+	vpcs              map[string]*ec2.Vpc
+	subnets           map[string]*ec2.Subnet
+	networkInterfaces map[string]*ec2.NetworkInterface
+	routeTables       map[string]*ec2.RouteTable
+
+	failures map[string]error
+	calls    map[string]int
+	nextID   int
+
+	// accessKeyIDs are the access keys of the requests served over HTTP
+	accessKeyIDs map[string]bool
+}
+
+func NewEC2() *EC2 {
+	return &EC2{
+		vpcs:              map[string]*ec2.Vpc{},
+		subnets:           map[string]*ec2.Subnet{},
+		networkInterfaces: map[string]*ec2.NetworkInterface{},
+		routeTables:       map[string]*ec2.RouteTable{},
+		failures:          map[string]error{},
+		calls:             map[string]int{},
+		accessKeyIDs:      map[string]bool{},
+	}
+}
+
+// AddVPC creates a VPC with the primary CIDR block and returns its ID
+func (f *EC2) AddVPC(cidrBlock string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.id("vpc")
+	f.vpcs[id] = &ec2.Vpc{
+		VpcId:     aws.String(id),
+		CidrBlock: aws.String(cidrBlock),
+		CidrBlockAssociationSet: []*ec2.VpcCidrBlockAssociation{
+			{
+				AssociationId:  aws.String(f.id("vpc-cidr-assoc")),
+				CidrBlock:      aws.String(cidrBlock),
+				CidrBlockState: &ec2.VpcCidrBlockState{State: aws.String(ec2.VpcCidrBlockStateCodeAssociated)},
+			},
+		},
+	}
+	return id
+}
+
+// DeleteVPC removes the VPC as if it was deleted by CAPA
+func (f *EC2) DeleteVPC(vpcID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.vpcs, vpcID)
+}
+
+// AddRouteTable creates a route table in the VPC and returns its ID
+func (f *EC2) AddRouteTable(vpcID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.id("rtb")
+	f.routeTables[id] = &ec2.RouteTable{
+		RouteTableId: aws.String(id),
+		VpcId:        aws.String(vpcID),
+	}
+	return id
+}
+
+// AddSubnet creates a subnet which is not managed by the operator and returns its ID
+func (f *EC2) AddSubnet(vpcID string, az string, cidrBlock string, tags map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ec2Tags []*ec2.Tag
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	id := f.id("subnet")
+	f.subnets[id] = &ec2.Subnet{
+		AvailabilityZone:        aws.String(az),
+		AvailableIpAddressCount: aws.Int64(availableIPs(cidrBlock)),
+		CidrBlock:               aws.String(cidrBlock),
+		SubnetId:                aws.String(id),
+		Tags:                    ec2Tags,
+		VpcId:                   aws.String(vpcID),
+	}
+	return id
+}
+
+// AddNetworkInterface creates a network interface in the subnet, optionally attached to an instance, and returns its ID
+func (f *EC2) AddNetworkInterface(subnetID string, attached bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.id("eni")
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: aws.String(id),
+		SubnetId:           aws.String(subnetID),
+		Status:             aws.String(ec2.NetworkInterfaceStatusAvailable),
+	}
+	if s, ok := f.subnets[subnetID]; ok {
+		eni.VpcId = aws.String(aws.StringValue(s.VpcId))
+	}
+	if attached {
+		eni.Attachment = &ec2.NetworkInterfaceAttachment{AttachmentId: aws.String(f.id("eni-attach"))}
+		eni.Status = aws.String(ec2.NetworkInterfaceStatusInUse)
+	}
+	f.networkInterfaces[id] = eni
+
+	if s, ok := f.subnets[subnetID]; ok {
+		s.AvailableIpAddressCount = aws.Int64(aws.Int64Value(s.AvailableIpAddressCount) - 1)
+	}
+	return id
+}
+
+// SetAvailableIPs overrides number of free IP addresses reported for the subnet
+func (f *EC2) SetAvailableIPs(subnetID string, count int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s, ok := f.subnets[subnetID]; ok {
+		s.AvailableIpAddressCount = aws.Int64(count)
+	}
+}
+
+// Fail makes every following call of the operation return the error, nil error clears the failure
+func (f *EC2) Fail(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.failures, operation)
+		return
+	}
+	f.failures[operation] = err
+}
+
+// Calls returns how many times the operation was called
+func (f *EC2) Calls(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[operation]
+}
+
+// VPC returns copy of the VPC or nil if it does not exist
+func (f *EC2) VPC(vpcID string) *ec2.Vpc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.vpcs[vpcID]
+	if !ok {
+		return nil
+	}
+	return awsutil.CopyOf(v).(*ec2.Vpc)
+}
+
+// Subnets returns copies of all subnets in the VPC
+func (f *EC2) Subnets(vpcID string) []*ec2.Subnet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var subnets []*ec2.Subnet
+	for _, s := range f.subnets {
+		if aws.StringValue(s.VpcId) == vpcID {
+			subnets = append(subnets, awsutil.CopyOf(s).(*ec2.Subnet))
+		}
+	}
+	return subnets
+}
+
+// NetworkInterfaces returns copies of all network interfaces in the subnet
+func (f *EC2) NetworkInterfaces(subnetID string) []*ec2.NetworkInterface {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var enis []*ec2.NetworkInterface
+	for _, eni := range f.networkInterfaces {
+		if aws.StringValue(eni.SubnetId) == subnetID {
+			enis = append(enis, awsutil.CopyOf(eni).(*ec2.NetworkInterface))
+		}
+	}
+	return enis
+}
+
+// RouteTableOf returns ID of the route table explicitly associated with the subnet
+func (f *EC2) RouteTableOf(subnetID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rt := range f.routeTables {
+		for _, a := range rt.Associations {
+			if aws.StringValue(a.SubnetId) == subnetID {
+				return aws.StringValue(rt.RouteTableId)
+			}
+		}
+	}
+	return ""
+}
+
+func (f *EC2) AssociateRouteTable(i *ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("AssociateRouteTable"); err != nil {
+		return nil, err
+	}
+
+	rt, ok := f.routeTables[aws.StringValue(i.RouteTableId)]
+	if !ok {
+		return nil, notFound("InvalidRouteTableID.NotFound", aws.StringValue(i.RouteTableId))
+	}
+	if _, ok := f.subnets[aws.StringValue(i.SubnetId)]; !ok {
+		return nil, notFound("InvalidSubnetID.NotFound", aws.StringValue(i.SubnetId))
+	}
+	for _, other := range f.routeTables {
+		for _, a := range other.Associations {
+			if aws.StringValue(a.SubnetId) == aws.StringValue(i.SubnetId) {
+				return nil, awserr.New("Resource.AlreadyAssociated", fmt.Sprintf("the subnet %s is already associated with route table %s", aws.StringValue(i.SubnetId), aws.StringValue(other.RouteTableId)), nil)
+			}
+		}
+	}
+
+	id := f.id("rtbassoc")
+	rt.Associations = append(rt.Associations, &ec2.RouteTableAssociation{
+		RouteTableAssociationId: aws.String(id),
+		RouteTableId:            rt.RouteTableId,
+		SubnetId:                i.SubnetId,
+	})
+	return &ec2.AssociateRouteTableOutput{AssociationId: aws.String(id)}, nil
+}
+
+func (f *EC2) AssociateVpcCidrBlock(i *ec2.AssociateVpcCidrBlockInput) (*ec2.AssociateVpcCidrBlockOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("AssociateVpcCidrBlock"); err != nil {
+		return nil, err
+	}
+
+	vpc, ok := f.vpcs[aws.StringValue(i.VpcId)]
+	if !ok {
+		return nil, notFound("InvalidVpcID.NotFound", aws.StringValue(i.VpcId))
+	}
+	_, cidr, err := net.ParseCIDR(aws.StringValue(i.CidrBlock))
+	if err != nil {
+		return nil, awserr.New("InvalidParameterValue", err.Error(), nil)
+	}
+	for _, a := range vpc.CidrBlockAssociationSet {
+		if overlaps(aws.StringValue(a.CidrBlock), cidr.String()) {
+			return nil, awserr.New("InvalidVpc.Range", fmt.Sprintf("the CIDR %s conflicts with %s", cidr.String(), aws.StringValue(a.CidrBlock)), nil)
+		}
+	}
+
+	association := &ec2.VpcCidrBlockAssociation{
+		AssociationId:  aws.String(f.id("vpc-cidr-assoc")),
+		CidrBlock:      aws.String(cidr.String()),
+		CidrBlockState: &ec2.VpcCidrBlockState{State: aws.String(ec2.VpcCidrBlockStateCodeAssociated)},
+	}
+	vpc.CidrBlockAssociationSet = append(vpc.CidrBlockAssociationSet, association)
+	return &ec2.AssociateVpcCidrBlockOutput{
+		CidrBlockAssociation: awsutil.CopyOf(association).(*ec2.VpcCidrBlockAssociation),
+		VpcId:                vpc.VpcId,
+	}, nil
+}
+
+func (f *EC2) CreateSubnet(i *ec2.CreateSubnetInput) (*ec2.CreateSubnetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateSubnet"); err != nil {
+		return nil, err
+	}
+
+	vpc, ok := f.vpcs[aws.StringValue(i.VpcId)]
+	if !ok {
+		return nil, notFound("InvalidVpcID.NotFound", aws.StringValue(i.VpcId))
+	}
+	_, cidr, err := net.ParseCIDR(aws.StringValue(i.CidrBlock))
+	if err != nil {
+		return nil, awserr.New("InvalidParameterValue", err.Error(), nil)
+	}
+
+	inVPC := false
+	for _, a := range vpc.CidrBlockAssociationSet {
+		_, vpcCIDR, _ := net.ParseCIDR(aws.StringValue(a.CidrBlock))
+		if vpcCIDR != nil && contains(*vpcCIDR, *cidr) {
+			inVPC = true
+		}
+	}
+	if !inVPC {
+		return nil, awserr.New("InvalidSubnet.Range", fmt.Sprintf("the CIDR %s is invalid for vpc %s", cidr.String(), aws.StringValue(vpc.VpcId)), nil)
+	}
+	for _, s := range f.subnets {
+		if aws.StringValue(s.VpcId) == aws.StringValue(vpc.VpcId) && overlaps(aws.StringValue(s.CidrBlock), cidr.String()) {
+			return nil, awserr.New("InvalidSubnet.Conflict", fmt.Sprintf("the CIDR %s conflicts with subnet %s", cidr.String(), aws.StringValue(s.SubnetId)), nil)
+		}
+	}
+
+	var tags []*ec2.Tag
+	for _, ts := range i.TagSpecifications {
+		for _, t := range ts.Tags {
+			tags = append(tags, &ec2.Tag{Key: aws.String(aws.StringValue(t.Key)), Value: aws.String(aws.StringValue(t.Value))})
+		}
+	}
+
+	id := f.id("subnet")
+	subnet := &ec2.Subnet{
+		AvailabilityZone:        i.AvailabilityZone,
+		AvailableIpAddressCount: aws.Int64(availableIPs(cidr.String())),
+		CidrBlock:               aws.String(cidr.String()),
+		SubnetId:                aws.String(id),
+		Tags:                    tags,
+		VpcId:                   vpc.VpcId,
+	}
+	f.subnets[id] = subnet
+	return &ec2.CreateSubnetOutput{Subnet: awsutil.CopyOf(subnet).(*ec2.Subnet)}, nil
+}
+
+func (f *EC2) CreateTags(i *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+
+	// only subnet tags are tracked
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		if _, ok := f.subnets[id]; !ok {
+			return nil, notFound("InvalidSubnetID.NotFound", id)
+		}
+	}
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		s := f.subnets[id]
+		for _, t := range i.Tags {
+			updated := false
+			for _, existing := range s.Tags {
+				if aws.StringValue(existing.Key) == aws.StringValue(t.Key) {
+					existing.Value = aws.String(aws.StringValue(t.Value))
+					updated = true
+				}
+			}
+			if !updated {
+				s.Tags = append(s.Tags, &ec2.Tag{Key: aws.String(aws.StringValue(t.Key)), Value: aws.String(aws.StringValue(t.Value))})
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *EC2) DeleteNetworkInterface(i *ec2.DeleteNetworkInterfaceInput) (*ec2.DeleteNetworkInterfaceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteNetworkInterface"); err != nil {
+		return nil, err
+	}
+
+	eni, ok := f.networkInterfaces[aws.StringValue(i.NetworkInterfaceId)]
+	if !ok {
+		return nil, notFound("InvalidNetworkInterfaceID.NotFound", aws.StringValue(i.NetworkInterfaceId))
+	}
+	if eni.Attachment != nil {
+		return nil, awserr.New("InvalidNetworkInterface.InUse", fmt.Sprintf("network interface %s is currently in use", aws.StringValue(eni.NetworkInterfaceId)), nil)
+	}
+
+	delete(f.networkInterfaces, aws.StringValue(i.NetworkInterfaceId))
+	if s, ok := f.subnets[aws.StringValue(eni.SubnetId)]; ok {
+		s.AvailableIpAddressCount = aws.Int64(aws.Int64Value(s.AvailableIpAddressCount) + 1)
+	}
+	return &ec2.DeleteNetworkInterfaceOutput{}, nil
+}
+
+func (f *EC2) DeleteSubnet(i *ec2.DeleteSubnetInput) (*ec2.DeleteSubnetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteSubnet"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.subnets[aws.StringValue(i.SubnetId)]; !ok {
+		return nil, notFound("InvalidSubnetID.NotFound", aws.StringValue(i.SubnetId))
+	}
+	for _, eni := range f.networkInterfaces {
+		if aws.StringValue(eni.SubnetId) == aws.StringValue(i.SubnetId) {
+			return nil, awserr.New("DependencyViolation", fmt.Sprintf("the subnet %s has dependencies and cannot be deleted", aws.StringValue(i.SubnetId)), nil)
+		}
+	}
+
+	delete(f.subnets, aws.StringValue(i.SubnetId))
+	// route table associations are removed together with the subnet
+	for _, rt := range f.routeTables {
+		var associations []*ec2.RouteTableAssociation
+		for _, a := range rt.Associations {
+			if aws.StringValue(a.SubnetId) != aws.StringValue(i.SubnetId) {
+				associations = append(associations, a)
+			}
+		}
+		rt.Associations = associations
+	}
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+func (f *EC2) DeleteTags(i *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteTags"); err != nil {
+		return nil, err
+	}
+
+	// only subnet tags are tracked
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		if _, ok := f.subnets[id]; !ok {
+			return nil, notFound("InvalidSubnetID.NotFound", id)
+		}
+	}
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		s := f.subnets[id]
+		var tags []*ec2.Tag
+		for _, existing := range s.Tags {
+			deleted := false
+			for _, t := range i.Tags {
+				// tag without value deletes the key regardless of its value
+				if aws.StringValue(existing.Key) == aws.StringValue(t.Key) && (t.Value == nil || aws.StringValue(existing.Value) == aws.StringValue(t.Value)) {
+					deleted = true
+				}
+			}
+			if !deleted {
+				tags = append(tags, existing)
+			}
+		}
+		s.Tags = tags
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (f *EC2) DescribeNetworkInterfaces(i *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeNetworkInterfaces"); err != nil {
+		return nil, err
+	}
+
+	o := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, eni := range f.networkInterfaces {
+		if matches(i.Filters, func(name string) []string {
+			switch name {
+			case "vpc-id":
+				return []string{aws.StringValue(eni.VpcId)}
+			case "subnet-id":
+				return []string{aws.StringValue(eni.SubnetId)}
+			case "network-interface-id":
+				return []string{aws.StringValue(eni.NetworkInterfaceId)}
+			}
+			return nil
+		}) {
+			o.NetworkInterfaces = append(o.NetworkInterfaces, awsutil.CopyOf(eni).(*ec2.NetworkInterface))
+		}
+	}
+	return o, nil
+}
+
+func (f *EC2) DescribeRouteTables(i *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeRouteTables"); err != nil {
+		return nil, err
+	}
+
+	o := &ec2.DescribeRouteTablesOutput{}
+	for _, rt := range f.routeTables {
+		if matches(i.Filters, func(name string) []string {
+			switch name {
+			case "vpc-id":
+				return []string{aws.StringValue(rt.VpcId)}
+			case "route-table-id":
+				return []string{aws.StringValue(rt.RouteTableId)}
+			case "association.subnet-id":
+				var ids []string
+				for _, a := range rt.Associations {
+					ids = append(ids, aws.StringValue(a.SubnetId))
+				}
+				return ids
+			}
+			return nil
+		}) {
+			o.RouteTables = append(o.RouteTables, awsutil.CopyOf(rt).(*ec2.RouteTable))
+		}
+	}
+	return o, nil
+}
+
+func (f *EC2) DescribeSubnets(i *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+
+	ids := aws.StringValueSlice(i.SubnetIds)
+	for _, id := range ids {
+		if _, ok := f.subnets[id]; !ok {
+			return nil, notFound("InvalidSubnetID.NotFound", id)
+		}
+	}
+
+	o := &ec2.DescribeSubnetsOutput{}
+	for _, s := range f.subnets {
+		if len(ids) > 0 && !containsString(ids, aws.StringValue(s.SubnetId)) {
+			continue
+		}
+		if matches(i.Filters, func(name string) []string {
+			switch {
+			case name == "vpc-id":
+				return []string{aws.StringValue(s.VpcId)}
+			case name == "subnet-id":
+				return []string{aws.StringValue(s.SubnetId)}
+			case name == "availability-zone":
+				return []string{aws.StringValue(s.AvailabilityZone)}
+			case name == "cidr-block":
+				return []string{aws.StringValue(s.CidrBlock)}
+			case strings.HasPrefix(name, "tag:"):
+				for _, t := range s.Tags {
+					if aws.StringValue(t.Key) == strings.TrimPrefix(name, "tag:") {
+						return []string{aws.StringValue(t.Value)}
+					}
+				}
+			}
+			return nil
+		}) {
+			o.Subnets = append(o.Subnets, awsutil.CopyOf(s).(*ec2.Subnet))
+		}
+	}
+	return o, nil
+}
+
+func (f *EC2) DescribeVpcs(i *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeVpcs"); err != nil {
+		return nil, err
+	}
+
+	o := &ec2.DescribeVpcsOutput{}
+	for _, id := range aws.StringValueSlice(i.VpcIds) {
+		vpc, ok := f.vpcs[id]
+		if !ok {
+			return nil, notFound("InvalidVpcID.NotFound", id)
+		}
+		o.Vpcs = append(o.Vpcs, awsutil.CopyOf(vpc).(*ec2.Vpc))
+	}
+	return o, nil
+}
+
+func (f *EC2) DetachNetworkInterface(i *ec2.DetachNetworkInterfaceInput) (*ec2.DetachNetworkInterfaceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DetachNetworkInterface"); err != nil {
+		return nil, err
+	}
+
+	for _, eni := range f.networkInterfaces {
+		if eni.Attachment != nil && aws.StringValue(eni.Attachment.AttachmentId) == aws.StringValue(i.AttachmentId) {
+			eni.Attachment = nil
+			eni.Status = aws.String(ec2.NetworkInterfaceStatusAvailable)
+			return &ec2.DetachNetworkInterfaceOutput{}, nil
+		}
+	}
+	return nil, notFound("InvalidAttachmentID.NotFound", aws.StringValue(i.AttachmentId))
+}
+
+func (f *EC2) DisassociateVpcCidrBlock(i *ec2.DisassociateVpcCidrBlockInput) (*ec2.DisassociateVpcCidrBlockOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DisassociateVpcCidrBlock"); err != nil {
+		return nil, err
+	}
+
+	for _, vpc := range f.vpcs {
+		for j, a := range vpc.CidrBlockAssociationSet {
+			if aws.StringValue(a.AssociationId) != aws.StringValue(i.AssociationId) {
+				continue
+			}
+			if j == 0 {
+				return nil, awserr.New("OperationNotPermitted", "the vpc primary CIDR block cannot be disassociated", nil)
+			}
+			for _, s := range f.subnets {
+				if aws.StringValue(s.VpcId) == aws.StringValue(vpc.VpcId) && overlaps(aws.StringValue(s.CidrBlock), aws.StringValue(a.CidrBlock)) {
+					return nil, awserr.New("DependencyViolation", fmt.Sprintf("the CIDR %s has dependent subnet %s", aws.StringValue(a.CidrBlock), aws.StringValue(s.SubnetId)), nil)
+				}
+			}
+
+			vpc.CidrBlockAssociationSet = append(vpc.CidrBlockAssociationSet[:j], vpc.CidrBlockAssociationSet[j+1:]...)
+			return &ec2.DisassociateVpcCidrBlockOutput{
+				CidrBlockAssociation: awsutil.CopyOf(a).(*ec2.VpcCidrBlockAssociation),
+				VpcId:                vpc.VpcId,
+			}, nil
+		}
+	}
+	return nil, notFound("InvalidVpcCidrBlockAssociationID.NotFound", aws.StringValue(i.AssociationId))
+}
+
+func (f *EC2) ReplaceRouteTableAssociation(i *ec2.ReplaceRouteTableAssociationInput) (*ec2.ReplaceRouteTableAssociationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ReplaceRouteTableAssociation"); err != nil {
+		return nil, err
+	}
+
+	target, ok := f.routeTables[aws.StringValue(i.RouteTableId)]
+	if !ok {
+		return nil, notFound("InvalidRouteTableID.NotFound", aws.StringValue(i.RouteTableId))
+	}
+	for _, rt := range f.routeTables {
+		for j, a := range rt.Associations {
+			if aws.StringValue(a.RouteTableAssociationId) != aws.StringValue(i.AssociationId) {
+				continue
+			}
+			rt.Associations = append(rt.Associations[:j], rt.Associations[j+1:]...)
+
+			id := f.id("rtbassoc")
+			target.Associations = append(target.Associations, &ec2.RouteTableAssociation{
+				RouteTableAssociationId: aws.String(id),
+				RouteTableId:            target.RouteTableId,
+				SubnetId:                a.SubnetId,
+			})
+			return &ec2.ReplaceRouteTableAssociationOutput{NewAssociationId: aws.String(id)}, nil
+		}
+	}
+	return nil, notFound("InvalidAssociationID.NotFound", aws.StringValue(i.AssociationId))
+}
+
+// call records the call of the operation and returns the configured failure if any
+func (f *EC2) call(operation string) error {
+	f.calls[operation]++
+	return f.failures[operation]
+}
+
+func (f *EC2) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%017x", prefix, f.nextID)
+}
+
+func notFound(code string, id string) error {
+	return awserr.New(code, fmt.Sprintf("the ID '%s' does not exist", id), nil)
+}
+
+// matches returns true when the values returned for each filter name contain one of the filter values
+func matches(filters []*ec2.Filter, values func(name string) []string) bool {
+	for _, filter := range filters {
+		found := false
+		for _, v := range values(aws.StringValue(filter.Name)) {
+			if matchesAny(aws.StringValueSlice(filter.Values), v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny compares the value with filter values, * and ? wildcards are supported like in the EC2 API
+func matchesAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, "*?") {
+			if p == value {
+				return true
+			}
+			continue
+		}
+
+		expr := regexp.QuoteMeta(p)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		if regexp.MustCompile("^" + expr + "$").MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(network net.IPNet, subnet net.IPNet) bool {
+	networkOnes, _ := network.Mask.Size()
+	subnetOnes, _ := subnet.Mask.Size()
+	return network.Contains(subnet.IP) && subnetOnes >= networkOnes
+}
+
+func overlaps(a string, b string) bool {
+	_, aNet, errA := net.ParseCIDR(a)
+	_, bNet, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return aNet.Contains(bNet.IP) || bNet.Contains(aNet.IP)
+}
+
+// availableIPs returns number of usable addresses in the CIDR, AWS reserves 5 addresses in every subnet
+func availableIPs(cidrBlock string) int64 {
+	_, n, err := net.ParseCIDR(cidrBlock)
+	if err != nil {
+		return 0
+	}
+	ones, bits := n.Mask.Size()
+	return int64(1)<<uint(bits-ones) - 5
+}
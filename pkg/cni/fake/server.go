@@ -0,0 +1,163 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/cni"
+)
+
+var (
+	ec2APIType = reflect.TypeOf((*cni.EC2API)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+
+	// credentialPattern matches the access key ID in the signature version 4 Authorization header
+	credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+)
+
+// ServeHTTP serves the operations of cni.EC2API using the EC2 query protocol, so AWS sessions created by the
+// operator can use the fake as EC2 endpoint. The requests are not verified, only the access key IDs they are
+// signed with are recorded.
+func (f *EC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, awserr.New("MalformedQueryString", err.Error(), nil))
+		return
+	}
+
+	if m := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		f.mu.Lock()
+		f.accessKeyIDs[m[1]] = true
+		f.mu.Unlock()
+	}
+
+	action := r.PostForm.Get("Action")
+	method, ok := ec2APIType.MethodByName(action)
+	if !ok {
+		writeError(w, http.StatusBadRequest, awserr.New("InvalidAction", fmt.Sprintf("the action %s is not valid for this web service", action), nil))
+		return
+	}
+
+	input := reflect.New(method.Type.In(0).Elem())
+	decodeStruct(r.PostForm, input.Elem(), "")
+
+	out := reflect.ValueOf(f).MethodByName(action).Call([]reflect.Value{input})
+	if !out[1].IsNil() {
+		err := out[1].Convert(errorType).Interface().(error)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var body bytes.Buffer
+	err = xmlutil.BuildXML(out[0].Interface(), xml.NewEncoder(&body))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, awserr.New("InternalError", err.Error(), nil))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, "<%sResponse>%s</%sResponse>", action, body.String(), action)
+}
+
+// AccessKeyIDs returns the access key IDs of the signed requests served over HTTP
+func (f *EC2) AccessKeyIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ids []string
+	for id := range f.accessKeyIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	code := "InternalError"
+	if awsErr, ok := err.(awserr.Error); ok {
+		code = awsErr.Code()
+	}
+
+	var message bytes.Buffer
+	_ = xml.EscapeText(&message, []byte(err.Error()))
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>fake</RequestID></Response>", code, message.String())
+}
+
+// decodeStruct sets the fields of the input from the EC2 query parameters, it is the reverse of the
+// serialization done by the AWS SDK for the types used by cni.EC2API
+func decodeStruct(values url.Values, v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("ignore") != "" {
+			continue
+		}
+
+		name := field.Tag.Get("queryName")
+		if name == "" {
+			name = field.Tag.Get("locationName")
+			if name != "" {
+				name = strings.ToUpper(name[0:1]) + name[1:]
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		decodeValue(values, v.Field(i), name)
+	}
+}
+
+func decodeValue(values url.Values, v reflect.Value, name string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !hasParameter(values, name) {
+			return
+		}
+		elem := reflect.New(v.Type().Elem())
+		decodeValue(values, elem.Elem(), name)
+		v.Set(elem)
+	case reflect.Struct:
+		decodeStruct(values, v, name)
+	case reflect.Slice:
+		for i := 1; hasParameter(values, name+"."+strconv.Itoa(i)); i++ {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			decodeValue(values, elem, name+"."+strconv.Itoa(i))
+			v.Set(reflect.Append(v, elem))
+		}
+	case reflect.String:
+		v.SetString(values.Get(name))
+	case reflect.Int64:
+		i, _ := strconv.ParseInt(values.Get(name), 10, 64)
+		v.SetInt(i)
+	case reflect.Bool:
+		v.SetBool(values.Get(name) == "true")
+	}
+}
+
+// hasParameter returns true when the value or any of its fields or elements is set
+func hasParameter(values url.Values, name string) bool {
+	for k := range values {
+		if k == name || strings.HasPrefix(k, name+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -2,34 +2,125 @@ package key
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"strings"
 
-	eni "github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/annotations"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/capa-aws-cni-operator/api/v1alpha1"
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/v1beta1"
 )
 
 const (
+	// V1alpha3APIVersion and V1beta1APIVersion are the supported versions of the Cluster API and CAPA APIs
+	V1alpha3APIVersion = "v1alpha3"
+	V1beta1APIVersion  = "v1beta1"
+
 	ClusterNameLabel        = "cluster.x-k8s.io/cluster-name"
 	ClusterWatchFilterLabel = "cluster.x-k8s.io/watch-filter"
 
 	FinalizerName = "capa-aws-cni-operator.finalizers.giantswarm.io"
 
+	ManagedByLabel      = "app.kubernetes.io/managed-by"
+	ManagedByLabelValue = "capa-aws-cni-operator"
+
 	AWSCniOperatorOwnedTag = "capa-aws-cni-operator.giantswarm.io"
+	// CNISubnetRole is the value of the CAPA role tag on CNI subnets
+	CNISubnetRole = "cni"
+
+	CNICIDRAnnotation            = "capa-aws-cni-operator.giantswarm.io/cni-cidr"
+	CNIAdditionalCIDRsAnnotation = "capa-aws-cni-operator.giantswarm.io/cni-additional-cidrs"
+	// CNIFirstReadyAnnotation records when the CNI of the cluster became ready for the first time
+	CNIFirstReadyAnnotation = "capa-aws-cni-operator.giantswarm.io/cni-first-ready"
+	// LastAppliedTagsAnnotation holds the additional tags applied to the CNI subnets as JSON
+	LastAppliedTagsAnnotation = "capa-aws-cni-operator.giantswarm.io/last-applied-tags"
 
 	CNINodeSecurityGroupName = "node"
+
+	KubeconfigSecretKey = "value"
+
+	DefaultExpansionUtilizationThreshold = 80
+	DefaultExpansionMaxAdditionalCIDRs   = 3
 )
 
-func GetClusterIDFromLabels(t metav1.ObjectMeta) string {
+const (
+	// AWSCNIReadyCondition reports whether the CNI resources for the cluster are reconciled
+	AWSCNIReadyCondition capi.ConditionType = "AWSCNIReady"
+
+	WaitingForVPCReason               = "WaitingForVPC"
+	WaitingForSubnetsReason           = "WaitingForSubnets"
+	WaitingForSecurityGroupReason     = "WaitingForSecurityGroup"
+	WaitingForWorkloadAPIReason       = "WaitingForWorkloadAPI"
+	ENIConfigCRDMissingReason         = "ENIConfigCRDMissing"
+	CIDRAllocationFailedReason        = "CIDRAllocationFailed"
+	CIDRAssociationFailedReason       = "CIDRAssociationFailed"
+	CIDRInUseReason                   = "CIDRInUse"
+	SubnetCreationFailedReason        = "SubnetCreationFailed"
+	RouteTableAssociationFailedReason = "RouteTableAssociationFailed"
+	SubnetDeletionFailedReason        = "SubnetDeletionFailed"
+	ENIConfigApplyFailedReason        = "ENIConfigApplyFailed"
+	SubnetValidationFailedReason      = "SubnetValidationFailed"
+	SubnetConflictReason              = "SubnetConflict"
+	ReconcileFailedReason             = "ReconcileFailed"
+	// CNISubnetCapacityCondition reports whether CNI subnets have enough free IP addresses
+	CNISubnetCapacityCondition capi.ConditionType = "CNISubnetCapacity"
+
+	SubnetIPsExhaustingReason = "SubnetIPsExhausting"
+	CapacityExpandedReason    = "CapacityExpanded"
+	// CNISubnetsDrainedCondition reports whether CNI subnets of AZs removed from the cluster are deleted,
+	// it does not affect AWSCNIReady as the remaining AZs are not affected
+	CNISubnetsDrainedCondition capi.ConditionType = "CNISubnetsDrained"
+
+	WaitingForSubnetDrainReason = "WaitingForSubnetDrain"
+	// CNIReconciliationPausedCondition is true while the cluster is paused and CNI resources are not reconciled
+	CNIReconciliationPausedCondition capi.ConditionType = "CNIReconciliationPaused"
+
+	// ReadyReason is only used for metrics, conditions which are true do not carry a reason
+	ReadyReason          = "Ready"
+	PausedReason         = "Paused"
+	DeletingReason       = "Deleting"
+	DeletionFailedReason = "DeletionFailed"
+)
+
+func GetClusterIDFromLabels(t metav1.Object) string {
 	return t.GetLabels()[ClusterNameLabel]
 }
 
+// GetCNICIDRFromAnnotations returns the per-cluster CNI CIDR override or empty string if not set
+func GetCNICIDRFromAnnotations(t metav1.Object) string {
+	return t.GetAnnotations()[CNICIDRAnnotation]
+}
+
+// GetLastAppliedTagsFromAnnotations returns the additional tags applied to the CNI subnets by the previous reconciliation
+func GetLastAppliedTagsFromAnnotations(t metav1.Object) (map[string]string, error) {
+	value := t.GetAnnotations()[LastAppliedTagsAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+
+	tags := map[string]string{}
+	err := json.Unmarshal([]byte(value), &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// GetAdditionalCNICIDRsFromAnnotations returns CNI CIDRs added by capacity expansion
+func GetAdditionalCNICIDRsFromAnnotations(t metav1.Object) []string {
+	value := t.GetAnnotations()[CNIAdditionalCIDRsAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 func GetAWSClusterByName(ctx context.Context, ctrlClient client.Client, clusterName string) (*capa.AWSCluster, error) {
 	awsClusterList := &capa.AWSClusterList{}
 
@@ -47,71 +138,100 @@ func GetAWSClusterByName(ctx context.Context, ctrlClient client.Client, clusterN
 	return &awsClusterList.Items[0], nil
 }
 
-func HasCapiWatchLabel(labels map[string]string) bool {
-	value, ok := labels[ClusterWatchFilterLabel]
-	if ok {
-		if value == "capi" {
-			return true
-		}
+// GetV1beta1AWSClusterByName returns the v1beta1 AWSCluster of the cluster
+func GetV1beta1AWSClusterByName(ctx context.Context, ctrlClient client.Client, clusterName string) (*v1beta1.AWSCluster, error) {
+	awsClusterList := &v1beta1.AWSClusterList{}
+
+	if err := ctrlClient.List(ctx,
+		awsClusterList,
+		client.MatchingLabels{ClusterNameLabel: clusterName},
+	); err != nil {
+		return nil, err
 	}
-	return false
+
+	if len(awsClusterList.Items) != 1 {
+		return nil, fmt.Errorf("expected 1 AWSCluster but found %d", len(awsClusterList.Items))
+	}
+
+	return &awsClusterList.Items[0], nil
 }
 
-// GetWCK8sClient will return workload cluster k8s controller-runtime client
-func GetWCK8sClient(ctx context.Context, ctrlClient client.Client, clusterName string, clusterNamespace string) (client.Client, error) {
-	var err error
-
-	if _, err := os.Stat(tempKubeconfigFileName(clusterName)); err == nil {
-		// kubeconfig file already exists, no need to fetch and write again
-
-	} else if os.IsNotExist(err) {
-		// kubeconfig dont exists we need to fetch it and write to file
-		var secret corev1.Secret
-		{
-			err = ctrlClient.Get(ctx, client.ObjectKey{
-				Name:      fmt.Sprintf("%s-kubeconfig", clusterName),
-				Namespace: clusterNamespace,
-			},
-				&secret)
-
-			if err != nil {
-				return nil, err
-			}
+// GetV1beta1OwnerCluster returns the v1beta1 Cluster owning the object or nil if the owner reference is not set yet
+func GetV1beta1OwnerCluster(ctx context.Context, ctrlClient client.Client, obj metav1.Object) (*v1beta1.Cluster, error) {
+	for _, ref := range obj.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return nil, err
 		}
-		err = ioutil.WriteFile(tempKubeconfigFileName(clusterName), secret.Data["value"], 0600)
+		if ref.Kind != "Cluster" || gv.Group != v1beta1.ClusterGroupVersion.Group {
+			continue
+		}
+
+		cluster := &v1beta1.Cluster{}
+		err = ctrlClient.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, cluster)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		return nil, err
+		return cluster, nil
 	}
+	return nil, nil
+}
 
-	config, err := clientcmd.BuildConfigFromFlags("", tempKubeconfigFileName(clusterName))
-	if err != nil {
-		return nil, err
+// GetPrivateRouteTableIDs returns map of AZ to the route table ID of the private subnet in that AZ
+func GetPrivateRouteTableIDs(subnets capa.Subnets) map[string]string {
+	routeTableIDs := map[string]string{}
+	for _, s := range subnets.FilterPrivate() {
+		if s.RouteTableID != nil && *s.RouteTableID != "" {
+			routeTableIDs[s.AvailabilityZone] = *s.RouteTableID
+		}
 	}
+	return routeTableIDs
+}
 
-	scheme := runtime.NewScheme()
-	_ = eni.AddToScheme(scheme)
+// GetAWSCNIConfig returns AWSCNIConfig of the cluster or nil if the cluster does not have any
+func GetAWSCNIConfig(ctx context.Context, ctrlClient client.Client, clusterName string, clusterNamespace string) (*v1alpha1.AWSCNIConfig, error) {
+	awsCNIConfigList := &v1alpha1.AWSCNIConfigList{}
 
-	wcClient, err := client.New(config, client.Options{Scheme: scheme})
-	if err != nil {
+	if err := ctrlClient.List(ctx,
+		awsCNIConfigList,
+		client.InNamespace(clusterNamespace),
+		client.MatchingLabels{ClusterNameLabel: clusterName},
+	); err != nil {
 		return nil, err
 	}
 
-	return wcClient, nil
+	if len(awsCNIConfigList.Items) == 0 {
+		return nil, nil
+	} else if len(awsCNIConfigList.Items) > 1 {
+		return nil, fmt.Errorf("expected at most 1 AWSCNIConfig but found %d", len(awsCNIConfigList.Items))
+	}
+
+	return &awsCNIConfigList.Items[0], nil
 }
 
-// CleanWCK8sKubeconfig will clean old kubeconfig file to avoid issue when cluster is recreated with same ID
-func CleanWCK8sKubeconfig(clusterName string) error {
-	err := os.Remove(tempKubeconfigFileName(clusterName))
-	if os.IsNotExist(err) {
-		// we ignore if the file is already deleted
-	} else if err != nil {
-		return err
+// HasWatchFilterLabel returns true when the object should be reconciled for the watch filter value,
+// empty value matches every object
+func HasWatchFilterLabel(labels map[string]string, watchFilterValue string) bool {
+	if watchFilterValue == "" {
+		return true
 	}
+	return labels[ClusterWatchFilterLabel] == watchFilterValue
+}
 
-	return nil
+// IsPaused returns true when the Cluster or the AWSCluster is paused, cluster can be nil if it does not exist yet
+func IsPaused(cluster *capi.Cluster, awsCluster metav1.Object) bool {
+	if annotations.HasPausedAnnotation(awsCluster) {
+		return true
+	}
+	return cluster != nil && (cluster.Spec.Paused || annotations.HasPausedAnnotation(cluster))
+}
+
+// IsV1beta1Paused returns true when the v1beta1 Cluster or the AWSCluster is paused, cluster can be nil if it does not exist yet
+func IsV1beta1Paused(cluster *v1beta1.Cluster, awsCluster metav1.Object) bool {
+	if annotations.HasPausedAnnotation(awsCluster) {
+		return true
+	}
+	return cluster != nil && (cluster.Spec.Paused || annotations.HasPausedAnnotation(cluster))
 }
 
 func HasFinalizer(finalizers []string) bool {
@@ -123,6 +243,12 @@ func HasFinalizer(finalizers []string) bool {
 	return false
 }
 
-func tempKubeconfigFileName(clusterName string) string {
-	return fmt.Sprintf("/tmp/kubeconfig-%s", clusterName)
+// KubeconfigSecretName returns name of the secret with the workload cluster kubeconfig
+func KubeconfigSecretName(clusterName string) string {
+	return fmt.Sprintf("%s-kubeconfig", clusterName)
+}
+
+// UserKubeconfigSecretName returns name of the secret with the EKS workload cluster kubeconfig
+func UserKubeconfigSecretName(clusterName string) string {
+	return fmt.Sprintf("%s-user-kubeconfig", clusterName)
 }
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	metricNamespace = "capa_aws_cni_operator"
+)
+
+var (
+	awsAPICallsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: "aws_api",
+			Name:      "calls_total",
+			Help:      "Total number of AWS API calls by service and operation.",
+		},
+		[]string{"service", "operation"},
+	)
+	awsAPICallErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: "aws_api",
+			Name:      "call_errors_total",
+			Help:      "Total number of failed AWS API calls by service, operation and error code.",
+		},
+		[]string{"service", "operation", "code"},
+	)
+	awsAPICallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Subsystem: "aws_api",
+			Name:      "call_duration_seconds",
+			Help:      "Duration of AWS API calls including retries by service and operation.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"service", "operation"},
+	)
+	cniSubnets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "cni_subnets",
+			Help:      "Number of CNI subnets managed for the cluster.",
+		},
+		[]string{"cluster_namespace", "cluster"},
+	)
+	cniSubnetAvailableIPs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "cni_subnet_available_ips",
+			Help:      "Number of free IP addresses in the CNI subnet of the cluster availability zone.",
+		},
+		[]string{"cluster_namespace", "cluster", "availability_zone"},
+	)
+	reconcileOutcomeTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "reconcile_outcome_total",
+			Help:      "Total number of AWSCluster reconciliations by outcome reason.",
+		},
+		[]string{"reason"},
+	)
+	timeToReady = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Name:      "time_to_ready_seconds",
+			Help:      "Time from AWSCluster creation until ENIConfigs are applied in the workload cluster for the first time.",
+			Buckets:   []float64{60, 120, 300, 600, 900, 1200, 1800, 2700, 3600, 7200},
+		},
+	)
+)
+
+var (
+	// cniSubnetAZs are the availability zones with free IP metrics by cluster, so the metrics of AZs removed
+	// from the cluster can be deleted
+	cniSubnetAZs   = map[string]map[string]bool{}
+	cniSubnetAZsMu sync.Mutex
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		awsAPICallsTotal,
+		awsAPICallErrorsTotal,
+		awsAPICallDuration,
+		cniSubnets,
+		cniSubnetAvailableIPs,
+		reconcileOutcomeTotal,
+		timeToReady,
+	)
+}
+
+// InstrumentAWSClient will record calls, errors and latency of all requests sent by the AWS service client
+func InstrumentAWSClient(c *awsclient.Client) {
+	c.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "capa-aws-cni-operator/metrics",
+		Fn: func(r *request.Request) {
+			service := r.ClientInfo.ServiceName
+			operation := r.Operation.Name
+
+			awsAPICallsTotal.WithLabelValues(service, operation).Inc()
+			awsAPICallDuration.WithLabelValues(service, operation).Observe(time.Since(r.Time).Seconds())
+
+			if r.Error != nil {
+				code := "Unknown"
+				if aerr, ok := r.Error.(awserr.Error); ok {
+					code = aerr.Code()
+				}
+				awsAPICallErrorsTotal.WithLabelValues(service, operation, code).Inc()
+			}
+		},
+	})
+}
+
+// SetCNISubnets records number of CNI subnets managed for the cluster
+func SetCNISubnets(clusterNamespace string, clusterName string, count int) {
+	cniSubnets.WithLabelValues(clusterNamespace, clusterName).Set(float64(count))
+}
+
+// DeleteCNISubnets removes CNI subnet metric of a deleted cluster
+func DeleteCNISubnets(clusterNamespace string, clusterName string) {
+	cniSubnets.DeleteLabelValues(clusterNamespace, clusterName)
+}
+
+// SetCNISubnetAvailableIPs records number of free IP addresses in the CNI subnet
+func SetCNISubnetAvailableIPs(clusterNamespace string, clusterName string, az string, count int64) {
+	cniSubnetAZsMu.Lock()
+	defer cniSubnetAZsMu.Unlock()
+
+	cluster := clusterNamespace + "/" + clusterName
+	if cniSubnetAZs[cluster] == nil {
+		cniSubnetAZs[cluster] = map[string]bool{}
+	}
+	cniSubnetAZs[cluster][az] = true
+	cniSubnetAvailableIPs.WithLabelValues(clusterNamespace, clusterName, az).Set(float64(count))
+}
+
+// DeleteCNISubnetAvailableIPs removes free IP metrics of the cluster CNI subnets except those of the kept AZs,
+// all of them are removed when no AZ is kept
+func DeleteCNISubnetAvailableIPs(clusterNamespace string, clusterName string, keepAZs []string) {
+	cniSubnetAZsMu.Lock()
+	defer cniSubnetAZsMu.Unlock()
+
+	keep := map[string]bool{}
+	for _, az := range keepAZs {
+		keep[az] = true
+	}
+
+	cluster := clusterNamespace + "/" + clusterName
+	for az := range cniSubnetAZs[cluster] {
+		if keep[az] {
+			continue
+		}
+		cniSubnetAvailableIPs.DeleteLabelValues(clusterNamespace, clusterName, az)
+		delete(cniSubnetAZs[cluster], az)
+	}
+	if len(cniSubnetAZs[cluster]) == 0 {
+		delete(cniSubnetAZs, cluster)
+	}
+}
+
+// ObserveReconcileOutcome counts reconciliation result by its condition reason
+func ObserveReconcileOutcome(reason string) {
+	reconcileOutcomeTotal.WithLabelValues(reason).Inc()
+}
+
+// ObserveTimeToReady records time between cluster creation and CNI being ready, it must be called once per cluster
+func ObserveTimeToReady(creationTimestamp time.Time) {
+	timeToReady.Observe(time.Since(creationTimestamp).Seconds())
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_DeleteCNISubnetAvailableIPs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		keepAZs []string
+		// expectedSeries are the remaining series of the cluster
+		expectedSeries int
+	}{
+		{
+			name:           "case 0: removed AZ is deleted",
+			keepAZs:        []string{"eu-west-1a", "eu-west-1b"},
+			expectedSeries: 2,
+		},
+		{
+			name:           "case 1: all AZs are deleted",
+			expectedSeries: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cniSubnetAvailableIPs.Reset()
+
+			for _, az := range []string{"eu-west-1a", "eu-west-1b", "eu-west-1c"} {
+				SetCNISubnetAvailableIPs("org-test", "test", az, 10)
+			}
+			SetCNISubnetAvailableIPs("org-test", "other", "eu-west-1c", 10)
+
+			DeleteCNISubnetAvailableIPs("org-test", "test", tc.keepAZs)
+
+			series := testutil.CollectAndCount(cniSubnetAvailableIPs)
+			if series != tc.expectedSeries+1 {
+				t.Fatalf("expected %d series, got %d", tc.expectedSeries+1, series)
+			}
+			if testutil.ToFloat64(cniSubnetAvailableIPs.WithLabelValues("org-test", "other", "eu-west-1c")) != 10 {
+				t.Fatal("expected series of other cluster to be kept")
+			}
+
+			DeleteCNISubnetAvailableIPs("org-test", "other", nil)
+		})
+	}
+}
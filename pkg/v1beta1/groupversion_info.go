@@ -0,0 +1,36 @@
+// Package v1beta1 contains the subset of the Cluster API and CAPA v1beta1 types the operator reads and writes.
+// Fields whose schema did not change since v1alpha3 reuse the v1alpha3 types, fields the operator does not
+// need are left out, so objects must only be written with patches and never with updates. The served CRD schemas
+// are checked against the types at start-up, see SchemaChecks.
+//+kubebuilder:object:generate=true
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// ClusterGroupVersion is group version of the CAPI Cluster
+	ClusterGroupVersion = schema.GroupVersion{Group: "cluster.x-k8s.io", Version: "v1beta1"}
+	// InfrastructureGroupVersion is group version of the CAPA AWSCluster and identities
+	InfrastructureGroupVersion = schema.GroupVersion{Group: "infrastructure.cluster.x-k8s.io", Version: "v1beta1"}
+	// ControlPlaneGroupVersion is group version of the CAPA AWSManagedControlPlane
+	ControlPlaneGroupVersion = schema.GroupVersion{Group: "controlplane.cluster.x-k8s.io", Version: "v1beta1"}
+
+	clusterSchemeBuilder        = &scheme.Builder{GroupVersion: ClusterGroupVersion}
+	infrastructureSchemeBuilder = &scheme.Builder{GroupVersion: InfrastructureGroupVersion}
+	controlPlaneSchemeBuilder   = &scheme.Builder{GroupVersion: ControlPlaneGroupVersion}
+)
+
+// AddToScheme adds the types of all group versions to the given scheme.
+func AddToScheme(s *runtime.Scheme) error {
+	for _, b := range []*scheme.Builder{clusterSchemeBuilder, infrastructureSchemeBuilder, controlPlaneSchemeBuilder} {
+		err := b.AddToScheme(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
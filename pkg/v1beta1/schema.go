@@ -0,0 +1,156 @@
+package v1beta1
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+)
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// +kubebuilder:object:generate=false
+
+// SchemaCheck pairs a v1beta1 CRD with the type the operator decodes its objects into
+type SchemaCheck struct {
+	// CRDName is the name of the CustomResourceDefinition
+	CRDName string
+	Version string
+	Type    interface{}
+	// Skip are the field paths which are handled separately, e.g. spec.secretRef of the static identity
+	Skip []string
+}
+
+// SchemaChecks returns the CRDs whose v1beta1 schema has to contain every field of the types the operator
+// decodes the objects into. The types are subsets reusing v1alpha3 types, so the check reports drift from CAPA
+// before objects are decoded with missing or renamed fields.
+func SchemaChecks(eksEnabled bool) []SchemaCheck {
+	checks := []SchemaCheck{
+		{CRDName: "clusters." + ClusterGroupVersion.Group, Version: ClusterGroupVersion.Version, Type: Cluster{}},
+		{CRDName: "awsclusters." + InfrastructureGroupVersion.Group, Version: InfrastructureGroupVersion.Version, Type: AWSCluster{}},
+		{CRDName: "awsclustercontrolleridentities." + InfrastructureGroupVersion.Group, Version: InfrastructureGroupVersion.Version, Type: capa.AWSClusterControllerIdentity{}},
+		{CRDName: "awsclusterroleidentities." + InfrastructureGroupVersion.Group, Version: InfrastructureGroupVersion.Version, Type: capa.AWSClusterRoleIdentity{}},
+		// v1beta1 references the secret only by name, it is read separately
+		{CRDName: "awsclusterstaticidentities." + InfrastructureGroupVersion.Group, Version: InfrastructureGroupVersion.Version, Type: capa.AWSClusterStaticIdentity{}, Skip: []string{"spec.secretRef"}},
+	}
+	if eksEnabled {
+		checks = append(checks, SchemaCheck{CRDName: "awsmanagedcontrolplanes." + ControlPlaneGroupVersion.Group, Version: ControlPlaneGroupVersion.Version, Type: AWSManagedControlPlane{}})
+	}
+	return checks
+}
+
+// CheckSchema returns error when the schema of the CRD version does not contain all fields of the type
+func (c SchemaCheck) CheckSchema(crd *apiextensionsv1.CustomResourceDefinition) error {
+	var schema *apiextensionsv1.JSONSchemaProps
+	for _, v := range crd.Spec.Versions {
+		if v.Name == c.Version && v.Schema != nil {
+			schema = v.Schema.OpenAPIV3Schema
+			break
+		}
+	}
+	if schema == nil {
+		return fmt.Errorf("CRD %s has no schema for version %s", crd.Name, c.Version)
+	}
+
+	missing := MissingFields(reflect.TypeOf(c.Type), schema, c.Skip)
+	if len(missing) > 0 {
+		return fmt.Errorf("schema of CRD %s version %s does not match the operator types, missing fields: %s", crd.Name, c.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MissingFields returns the json paths of the fields of the type which are not present in the schema,
+// the object metadata is not checked
+func MissingFields(t reflect.Type, schema *apiextensionsv1.JSONSchemaProps, skip []string) []string {
+	var missing []string
+	missingFields(t, schema, "", skip, &missing)
+	sort.Strings(missing)
+	return missing
+}
+
+func missingFields(t reflect.Type, schema *apiextensionsv1.JSONSchemaProps, path string, skip []string, missing *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// types with custom json encoding, e.g. metav1.Time, are checked only by their presence
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return
+	}
+	// fields are not checked below schemas which preserve unknown fields
+	if schema.XPreserveUnknownFields != nil && *schema.XPreserveUnknownFields {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 || schema.Items == nil || schema.Items.Schema == nil {
+			return
+		}
+		missingFields(t.Elem(), schema.Items.Schema, path+"[]", skip, missing)
+	case reflect.Map:
+		if schema.AdditionalProperties == nil || schema.AdditionalProperties.Schema == nil {
+			return
+		}
+		missingFields(t.Elem(), schema.AdditionalProperties.Schema, path+"{}", skip, missing)
+	case reflect.Struct:
+		if schema.Type != "" && schema.Type != "object" {
+			*missing = append(*missing, fmt.Sprintf("%s (%s instead of object)", path, schema.Type))
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, inline := jsonName(f)
+			if name == "-" || (name == "" && !inline) {
+				continue
+			}
+			if inline {
+				missingFields(f.Type, schema, path, skip, missing)
+				continue
+			}
+
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			if fieldPath == "metadata" || containsString(skip, fieldPath) {
+				continue
+			}
+
+			fieldSchema, ok := schema.Properties[name]
+			if !ok {
+				*missing = append(*missing, fieldPath)
+				continue
+			}
+			missingFields(f.Type, &fieldSchema, fieldPath, skip, missing)
+		}
+	}
+}
+
+// jsonName returns the json name of the exported struct field and whether the field is inlined
+func jsonName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" && !f.Anonymous {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	name := strings.Split(tag, ",")[0]
+	if strings.Contains(tag, ",inline") || (tag == "" && f.Anonymous) {
+		return "", true
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
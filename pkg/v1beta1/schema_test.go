@@ -0,0 +1,184 @@
+package v1beta1
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/yaml"
+)
+
+// Test_MissingFieldsV1alpha3CRDs checks the schema walk against the real CAPA CRDs, the v1alpha3 types
+// reused by the v1beta1 types must fully match the v1alpha3 schemas they were generated from
+func Test_MissingFieldsV1alpha3CRDs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		crdFile string
+		obj     interface{}
+	}{
+		{
+			name:    "case 0: AWSCluster",
+			crdFile: "infrastructure.cluster.x-k8s.io_awsclusters.yaml",
+			obj:     capa.AWSCluster{},
+		},
+		{
+			name:    "case 1: AWSClusterControllerIdentity",
+			crdFile: "infrastructure.cluster.x-k8s.io_awsclustercontrolleridentities.yaml",
+			obj:     capa.AWSClusterControllerIdentity{},
+		},
+		{
+			name:    "case 2: AWSClusterRoleIdentity",
+			crdFile: "infrastructure.cluster.x-k8s.io_awsclusterroleidentities.yaml",
+			obj:     capa.AWSClusterRoleIdentity{},
+		},
+		{
+			name:    "case 3: AWSClusterStaticIdentity",
+			crdFile: "infrastructure.cluster.x-k8s.io_awsclusterstaticidentities.yaml",
+			obj:     capa.AWSClusterStaticIdentity{},
+		},
+	}
+
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "sigs.k8s.io/cluster-api-provider-aws").Output()
+	if err != nil {
+		t.Fatalf("failed to find CAPA module: %s", err)
+	}
+	crdDir := filepath.Join(strings.TrimSpace(string(out)), "config", "crd", "bases")
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join(crdDir, tc.crdFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			err = yaml.Unmarshal(data, crd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			check := SchemaCheck{CRDName: crd.Name, Version: "v1alpha3", Type: tc.obj}
+			err = check.CheckSchema(crd)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_MissingFields(t *testing.T) {
+	object := func(properties map[string]apiextensionsv1.JSONSchemaProps) apiextensionsv1.JSONSchemaProps {
+		return apiextensionsv1.JSONSchemaProps{Type: "object", Properties: properties}
+	}
+	str := apiextensionsv1.JSONSchemaProps{Type: "string"}
+	subnets := apiextensionsv1.JSONSchemaProps{
+		Type: "array",
+		Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{
+			Type: "object",
+			Properties: map[string]apiextensionsv1.JSONSchemaProps{
+				"id": str, "cidrBlock": str, "availabilityZone": str, "isPublic": {Type: "boolean"},
+				"routeTableId": str, "natGatewayId": str, "tags": {Type: "object"},
+			},
+		}},
+	}
+	roleSpec := map[string]apiextensionsv1.JSONSchemaProps{
+		"allowedNamespaces": object(map[string]apiextensionsv1.JSONSchemaProps{
+			"list":     {Type: "array"},
+			"selector": object(map[string]apiextensionsv1.JSONSchemaProps{"matchLabels": {Type: "object"}, "matchExpressions": {Type: "array"}}),
+		}),
+		"durationSeconds":   {Type: "integer"},
+		"externalID":        str,
+		"inlinePolicy":      str,
+		"policyARNs":        {Type: "array"},
+		"roleARN":           str,
+		"sessionName":       str,
+		"sourceIdentityRef": object(map[string]apiextensionsv1.JSONSchemaProps{"kind": str, "name": str}),
+	}
+
+	testCases := []struct {
+		name            string
+		obj             interface{}
+		schema          apiextensionsv1.JSONSchemaProps
+		skip            []string
+		expectedMissing []string
+	}{
+		{
+			name: "case 0: schema with all fields",
+			obj:  Cluster{},
+			schema: object(map[string]apiextensionsv1.JSONSchemaProps{
+				"apiVersion": str,
+				"kind":       str,
+				"metadata":   {Type: "object"},
+				"spec":       object(map[string]apiextensionsv1.JSONSchemaProps{"paused": {Type: "boolean"}}),
+				"status": object(map[string]apiextensionsv1.JSONSchemaProps{
+					"infrastructureReady": {Type: "boolean"},
+					"controlPlaneReady":   {Type: "boolean"},
+					"conditions":          {Type: "array"},
+				}),
+			}),
+		},
+		{
+			name: "case 1: renamed and removed fields are reported",
+			obj:  Cluster{},
+			schema: object(map[string]apiextensionsv1.JSONSchemaProps{
+				"apiVersion": str,
+				"kind":       str,
+				"spec":       object(map[string]apiextensionsv1.JSONSchemaProps{"suspended": {Type: "boolean"}}),
+				"status":     object(map[string]apiextensionsv1.JSONSchemaProps{"conditions": {Type: "array"}}),
+			}),
+			expectedMissing: []string{"spec.paused", "status.controlPlaneReady", "status.infrastructureReady"},
+		},
+		{
+			name: "case 2: fields of reused v1alpha3 types are checked",
+			obj:  AWSClusterSpec{},
+			schema: object(map[string]apiextensionsv1.JSONSchemaProps{
+				"network": object(map[string]apiextensionsv1.JSONSchemaProps{
+					"vpc":     object(map[string]apiextensionsv1.JSONSchemaProps{"id": str}),
+					"subnets": subnets,
+				}),
+				"region":         str,
+				"additionalTags": {Type: "object"},
+				"identityRef":    object(map[string]apiextensionsv1.JSONSchemaProps{"kind": str, "name": str}),
+			}),
+			expectedMissing: []string{
+				"network.cni",
+				"network.securityGroupOverrides",
+				"network.vpc.availabilityZoneSelection",
+				"network.vpc.availabilityZoneUsageLimit",
+				"network.vpc.cidrBlock",
+				"network.vpc.internetGatewayId",
+				"network.vpc.tags",
+			},
+		},
+		{
+			name:            "case 3: object field changed to string is reported",
+			obj:             capa.AWSClusterStaticIdentitySpec{},
+			schema:          object(map[string]apiextensionsv1.JSONSchemaProps{"allowedNamespaces": roleSpec["allowedNamespaces"], "secretRef": str}),
+			expectedMissing: []string{"secretRef (string instead of object)"},
+		},
+		{
+			name:   "case 4: skipped fields are not checked",
+			obj:    capa.AWSClusterStaticIdentitySpec{},
+			schema: object(map[string]apiextensionsv1.JSONSchemaProps{"allowedNamespaces": roleSpec["allowedNamespaces"], "secretRef": str}),
+			skip:   []string{"secretRef"},
+		},
+		{
+			name:   "case 5: role identity",
+			obj:    capa.AWSClusterRoleIdentitySpec{},
+			schema: object(roleSpec),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			missing := MissingFields(reflect.TypeOf(tc.obj), &tc.schema, tc.skip)
+			if !reflect.DeepEqual(missing, tc.expectedMissing) {
+				t.Fatalf("expected missing fields %v, got %v", tc.expectedMissing, missing)
+			}
+		})
+	}
+}
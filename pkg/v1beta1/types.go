@@ -0,0 +1,138 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	capi "sigs.k8s.io/cluster-api/api/v1alpha3"
+)
+
+const (
+	// ControlPlaneInitializedCondition replaces the controlPlaneInitialized status field of v1alpha3 Cluster
+	ControlPlaneInitializedCondition capi.ConditionType = "ControlPlaneInitialized"
+)
+
+//+kubebuilder:object:root=true
+
+// Cluster is the CAPI Cluster
+type Cluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterSpec   `json:"spec,omitempty"`
+	Status ClusterStatus `json:"status,omitempty"`
+}
+
+type ClusterSpec struct {
+	Paused bool `json:"paused,omitempty"`
+}
+
+type ClusterStatus struct {
+	InfrastructureReady bool            `json:"infrastructureReady"`
+	ControlPlaneReady   bool            `json:"controlPlaneReady"`
+	Conditions          capi.Conditions `json:"conditions,omitempty"`
+}
+
+func (c *Cluster) GetConditions() capi.Conditions {
+	return c.Status.Conditions
+}
+
+func (c *Cluster) SetConditions(conditions capi.Conditions) {
+	c.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterList contains a list of Cluster
+type ClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Cluster `json:"items"`
+}
+
+//+kubebuilder:object:root=true
+
+// AWSCluster is the CAPA AWSCluster, the network spec moved to spec.network and the network status
+// to status.networkStatus
+type AWSCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSClusterSpec   `json:"spec,omitempty"`
+	Status AWSClusterStatus `json:"status,omitempty"`
+}
+
+type AWSClusterSpec struct {
+	NetworkSpec    capa.NetworkSpec           `json:"network,omitempty"`
+	Region         string                     `json:"region,omitempty"`
+	AdditionalTags capa.Tags                  `json:"additionalTags,omitempty"`
+	IdentityRef    *capa.AWSIdentityReference `json:"identityRef,omitempty"`
+}
+
+type AWSClusterStatus struct {
+	Network    capa.Network    `json:"networkStatus,omitempty"`
+	Conditions capi.Conditions `json:"conditions,omitempty"`
+}
+
+func (c *AWSCluster) GetConditions() capi.Conditions {
+	return c.Status.Conditions
+}
+
+func (c *AWSCluster) SetConditions(conditions capi.Conditions) {
+	c.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// AWSClusterList contains a list of AWSCluster
+type AWSClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSCluster `json:"items"`
+}
+
+//+kubebuilder:object:root=true
+
+// AWSManagedControlPlane is the CAPA EKS control plane, the network spec moved to spec.network and
+// the network status to status.networkStatus
+type AWSManagedControlPlane struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSManagedControlPlaneSpec   `json:"spec,omitempty"`
+	Status AWSManagedControlPlaneStatus `json:"status,omitempty"`
+}
+
+type AWSManagedControlPlaneSpec struct {
+	NetworkSpec    capa.NetworkSpec           `json:"network,omitempty"`
+	Region         string                     `json:"region,omitempty"`
+	AdditionalTags capa.Tags                  `json:"additionalTags,omitempty"`
+	IdentityRef    *capa.AWSIdentityReference `json:"identityRef,omitempty"`
+}
+
+type AWSManagedControlPlaneStatus struct {
+	Network    capa.Network    `json:"networkStatus,omitempty"`
+	Conditions capi.Conditions `json:"conditions,omitempty"`
+}
+
+func (c *AWSManagedControlPlane) GetConditions() capi.Conditions {
+	return c.Status.Conditions
+}
+
+func (c *AWSManagedControlPlane) SetConditions(conditions capi.Conditions) {
+	c.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// AWSManagedControlPlaneList contains a list of AWSManagedControlPlane
+type AWSManagedControlPlaneList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSManagedControlPlane `json:"items"`
+}
+
+func init() {
+	clusterSchemeBuilder.Register(&Cluster{}, &ClusterList{})
+	infrastructureSchemeBuilder.Register(&AWSCluster{}, &AWSClusterList{})
+	controlPlaneSchemeBuilder.Register(&AWSManagedControlPlane{}, &AWSManagedControlPlaneList{})
+}
@@ -0,0 +1,109 @@
+package v1beta1
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	capa "sigs.k8s.io/cluster-api-provider-aws/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const awsClusterJSON = `{
+	"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta1",
+	"kind": "AWSCluster",
+	"metadata": {"name": "test", "namespace": "default"},
+	"spec": {
+		"region": "eu-west-1",
+		"identityRef": {"kind": "AWSClusterRoleIdentity", "name": "test"},
+		"network": {
+			"vpc": {"id": "vpc-1"},
+			"subnets": [{"id": "subnet-1", "availabilityZone": "eu-west-1a", "isPublic": false, "routeTableId": "rtb-1"}]
+		},
+		"controlPlaneLoadBalancer": {"scheme": "internet-facing"}
+	},
+	"status": {
+		"ready": true,
+		"networkStatus": {
+			"securityGroups": {"node": {"id": "sg-1", "name": "test-node"}}
+		}
+	}
+}`
+
+func Test_AWSClusterDecoding(t *testing.T) {
+	awsCluster := &AWSCluster{}
+	err := json.Unmarshal([]byte(awsClusterJSON), awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if awsCluster.Spec.NetworkSpec.VPC.ID != "vpc-1" {
+		t.Fatalf("expected vpc id vpc-1, got %q", awsCluster.Spec.NetworkSpec.VPC.ID)
+	}
+	if len(awsCluster.Spec.NetworkSpec.Subnets.GetUniqueZones()) != 1 {
+		t.Fatalf("expected 1 zone, got %d", len(awsCluster.Spec.NetworkSpec.Subnets.GetUniqueZones()))
+	}
+	if awsCluster.Spec.Region != "eu-west-1" {
+		t.Fatalf("expected region eu-west-1, got %q", awsCluster.Spec.Region)
+	}
+	if awsCluster.Spec.IdentityRef == nil || awsCluster.Spec.IdentityRef.Kind != capa.ClusterRoleIdentityKind {
+		t.Fatalf("expected %s identity, got %v", capa.ClusterRoleIdentityKind, awsCluster.Spec.IdentityRef)
+	}
+	if awsCluster.Status.Network.SecurityGroups[capa.SecurityGroupNode].ID != "sg-1" {
+		t.Fatalf("expected node security group sg-1, got %q", awsCluster.Status.Network.SecurityGroups[capa.SecurityGroupNode].ID)
+	}
+}
+
+func Test_MergePatchOnlyContainsChanges(t *testing.T) {
+	awsCluster := &AWSCluster{}
+	err := json.Unmarshal([]byte(awsClusterJSON), awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fields missing in the subset of the types must never end up in a patch
+	patch := client.MergeFrom(awsCluster.DeepCopy())
+	awsCluster.Annotations = map[string]string{"test": "value"}
+
+	data, err := patch.Data(awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"metadata":{"annotations":{"test":"value"}}}`
+	if string(data) != expected {
+		t.Fatalf("expected patch %s, got %s", expected, string(data))
+	}
+}
+
+func Test_MergePatchRoundTrip(t *testing.T) {
+	awsCluster := &AWSCluster{}
+	err := json.Unmarshal([]byte(awsClusterJSON), awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := client.MergeFrom(awsCluster.DeepCopy())
+	awsCluster.Annotations = map[string]string{"test": "value"}
+	awsCluster.Finalizers = []string{"test"}
+	data, err := patch.Data(awsCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the API server applies the patch on the full object, fields missing in the types must survive it
+	patched, err := jsonpatch.MergePatch([]byte(awsClusterJSON), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var original, result map[string]interface{}
+	_ = json.Unmarshal([]byte(awsClusterJSON), &original)
+	_ = json.Unmarshal(patched, &result)
+
+	metadata := result["metadata"].(map[string]interface{})
+	delete(metadata, "annotations")
+	delete(metadata, "finalizers")
+	if !reflect.DeepEqual(original, result) {
+		t.Fatalf("expected patched object to keep all fields\nexpected %v\ngot      %v", original, result)
+	}
+}
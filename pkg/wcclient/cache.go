@@ -0,0 +1,112 @@
+package wcclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	eni "github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/capa-aws-cni-operator/pkg/key"
+)
+
+type CacheConfig struct {
+	CtrlClient client.Client
+	Log        logr.Logger
+}
+
+// Cache keeps workload cluster k8s clients in memory, a client is rebuilt
+// whenever the resourceVersion of the cluster kubeconfig secret changes
+type Cache struct {
+	ctrlClient client.Client
+	log        logr.Logger
+
+	mu      sync.Mutex
+	clients map[types.NamespacedName]cachedClient
+}
+
+type cachedClient struct {
+	client          client.Client
+	resourceVersion string
+}
+
+func NewCache(c CacheConfig) (*Cache, error) {
+	if c.CtrlClient == nil {
+		return nil, errors.New("failed to generate new wc client cache from nil CtrlClient")
+	}
+
+	if c.Log == nil {
+		return nil, errors.New("failed to generate new wc client cache from nil logger")
+	}
+
+	cache := &Cache{
+		ctrlClient: c.CtrlClient,
+		log:        c.Log,
+		clients:    map[types.NamespacedName]cachedClient{},
+	}
+	return cache, nil
+}
+
+// Get will return workload cluster k8s controller-runtime client built from the cluster kubeconfig secret
+func (c *Cache) Get(ctx context.Context, clusterName string, clusterNamespace string) (client.Client, error) {
+	return c.GetFromSecret(ctx, clusterName, clusterNamespace, key.KubeconfigSecretName(clusterName))
+}
+
+// GetFromSecret will return workload cluster k8s controller-runtime client built from the kubeconfig in the named secret
+func (c *Cache) GetFromSecret(ctx context.Context, clusterName string, clusterNamespace string, secretName string) (client.Client, error) {
+	var secret corev1.Secret
+	err := c.ctrlClient.Get(ctx, client.ObjectKey{Name: secretName, Namespace: clusterNamespace}, &secret)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.clients[cluster]; ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.client, nil
+	}
+
+	data, ok := secret.Data[key.KubeconfigSecretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s does not contain key %q", secret.Namespace, secret.Name, key.KubeconfigSecretKey)
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	_ = eni.AddToScheme(scheme)
+
+	wcClient, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.clients[cluster]; ok {
+		c.log.Info(fmt.Sprintf("kubeconfig secret of cluster %s changed, recreated wc k8s client", cluster))
+	}
+	c.clients[cluster] = cachedClient{client: wcClient, resourceVersion: secret.ResourceVersion}
+
+	return wcClient, nil
+}
+
+// Invalidate will drop the cached client of the cluster, it should be called when the cluster is deleted
+// so a cluster recreated with the same name does not reuse the client
+func (c *Cache) Invalidate(clusterName string, clusterNamespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.clients, types.NamespacedName{Name: clusterName, Namespace: clusterNamespace})
+}